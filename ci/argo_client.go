@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/tidwall/pretty"
@@ -12,15 +12,29 @@ import (
 
 type ArgoClient interface {
 	FetchBuildRunInfo(buildRunId string) (*BuildRun, error)
+	FetchBuildRunStatus(buildRunId string) (BuildRunStatus, error)
 	FetchBuildInfo(buildId string) (*BuildConfig, error)
 	FetchContainerRegistryAccess(crId string) (*RegistryAccess, error)
 	FetchBuildTimeSecrets(buildConfigId string) (*BuildSecretFetch, error)
 	BuildRunCallback(buildRunId string, payload *BuildRunCallbackPayload) error
+	BuildRunHeartbeat(buildRunId string, payload *BuildRunHeartbeatPayload) error
+	UploadBuildLogs(buildRunId string, chunk *BuildLogChunk) error
+	FetchDeployRunInfo(deployRunId string) (*DeployRun, error)
+	FetchClusterAccess(clusterId string) (*ClusterAccess, error)
+	DeployRunCallback(deployRunId string, payload *DeployRunCallbackPayload) error
 }
 
 type ArgoClientImpl struct {
 	*resty.Client
-	clientAuthInfo *GetClientIDAndSecretResponse
+	auth *tokenSource
+}
+
+func (c *ArgoClientImpl) withIdempotencyKey(key string) *resty.Request {
+	req := c.R()
+	if key != "" {
+		req.SetHeader("Idempotency-Key", key)
+	}
+	return req
 }
 
 func (c *ArgoClientImpl) FetchBuildRunInfo(buildRunId string) (*BuildRun, error) {
@@ -30,6 +44,17 @@ func (c *ArgoClientImpl) FetchBuildRunInfo(buildRunId string) (*BuildRun, error)
 	return &out, err
 }
 
+// FetchBuildRunStatus is FetchBuildRunInfo for the cancel poll, bounded by
+// periodicRequestTimeout.
+func (c *ArgoClientImpl) FetchBuildRunStatus(buildRunId string) (BuildRunStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), periodicRequestTimeout)
+	defer cancel()
+	out := BuildRun{}
+	resp, err := c.R().SetContext(ctx).Get(fmt.Sprintf("/api/v1/build/run/%s", buildRunId))
+	err = UnmarshalAndLog(resp, &out, err)
+	return out.Status, err
+}
+
 func (c *ArgoClientImpl) FetchBuildInfo(buildId string) (*BuildConfig, error) {
 	out := BuildConfig{}
 	resp, err := c.R().Get(fmt.Sprintf("/api/v1/build/%s", buildId))
@@ -37,7 +62,24 @@ func (c *ArgoClientImpl) FetchBuildInfo(buildId string) (*BuildConfig, error) {
 	return &out, err
 }
 func (c *ArgoClientImpl) BuildRunCallback(buildRunId string, payload *BuildRunCallbackPayload) error {
-	resp, err := c.R().SetBody(*payload).Post(fmt.Sprintf("/api/v1/build/run/%s/callback", buildRunId))
+	resp, err := c.withIdempotencyKey(payload.IdempotencyKey).SetBody(*payload).Post(fmt.Sprintf("/api/v1/build/run/%s/callback", buildRunId))
+	err = UnmarshalAndLog(resp, &map[string]interface{}{}, err)
+	return err
+}
+
+func (c *ArgoClientImpl) BuildRunHeartbeat(buildRunId string, payload *BuildRunHeartbeatPayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), periodicRequestTimeout)
+	defer cancel()
+	resp, err := c.R().SetContext(ctx).SetBody(*payload).Post(fmt.Sprintf("/api/v1/build/run/%s/heartbeat", buildRunId))
+	err = UnmarshalAndLog(resp, &map[string]interface{}{}, err)
+	return err
+}
+
+func (c *ArgoClientImpl) UploadBuildLogs(buildRunId string, chunk *BuildLogChunk) error {
+	// the client has no timeout of its own, a hung upload must not hold the log queue
+	ctx, cancel := context.WithTimeout(context.Background(), logUploadTimeout)
+	defer cancel()
+	resp, err := c.R().SetContext(ctx).SetBody(*chunk).Post(fmt.Sprintf("/api/v1/build/run/%s/logs", buildRunId))
 	err = UnmarshalAndLog(resp, &map[string]interface{}{}, err)
 	return err
 }
@@ -56,6 +98,26 @@ func (c *ArgoClientImpl) FetchBuildTimeSecrets(buildConfigId string) (*BuildSecr
 	return &out, err
 }
 
+func (c *ArgoClientImpl) FetchDeployRunInfo(deployRunId string) (*DeployRun, error) {
+	out := DeployRun{}
+	resp, err := c.R().Get(fmt.Sprintf("/api/v1/deploy/run/%s", deployRunId))
+	err = UnmarshalAndLog(resp, &out, err)
+	return &out, err
+}
+
+func (c *ArgoClientImpl) FetchClusterAccess(clusterId string) (*ClusterAccess, error) {
+	out := ClusterAccess{}
+	resp, err := c.R().Get(fmt.Sprintf("/api/v1/clusters/%s/access", clusterId))
+	err = UnmarshalAndLog(resp, &out, err)
+	return &out, err
+}
+
+func (c *ArgoClientImpl) DeployRunCallback(deployRunId string, payload *DeployRunCallbackPayload) error {
+	resp, err := c.withIdempotencyKey(payload.IdempotencyKey).SetBody(*payload).Post(fmt.Sprintf("/api/v1/deploy/run/%s/callback", deployRunId))
+	err = UnmarshalAndLog(resp, &map[string]interface{}{}, err)
+	return err
+}
+
 var argoClientInstance ArgoClient = nil
 
 func GetArgoClient() ArgoClient {
@@ -65,55 +127,22 @@ func GetArgoClient() ArgoClient {
 	return argoClientInstance
 }
 
-func InitializeArgoClient() (ArgoClient, error) {
+func InitializeArgoClient(key string, secret string, policy RetryPolicy) (ArgoClient, error) {
 
 	argoClient := &ArgoClientImpl{Client: resty.New()}
 
-	switch {
-	default:
-		key := os.Getenv("ARG_AUTH_KEY")
-		secret := os.Getenv("ARG_AUTH_SECRET")
-		if key == "" || secret == "" {
-			return nil, errors.New("access to argonaut server is not configured")
-		}
-		clientAuthInfo, err := getFEAuthInfo(key, secret)
-		if err != nil {
-			fmt.Printf("Could not construct client (internal err). Err: %v \n", err)
-			return nil, err
-		}
-		argoClient.clientAuthInfo = clientAuthInfo
-		argoClient.SetHeader("Authorization", clientAuthInfo.Accesstoken)
+	auth, err := newTokenSource(key, secret)
+	if err != nil {
+		fmt.Printf("Could not construct client (internal err). Err: %v \n", err)
+		return nil, err
 	}
+	argoClient.auth = auth
+	argoClient.OnBeforeRequest(auth.setAuthHeader)
 
 	argoClient.SetBaseURL(GetMidgardUrl())
 
-	argoClient.SetRetryCount(2).
-		AddRetryCondition(func(res *resty.Response, reqErr error) bool {
-
-			if reqErr != nil {
-				fmt.Printf("Request trace info for err. Err: %v  \n", reqErr)
-				fmt.Printf("Trace Info :  \n")
-				if res != nil && res.Request != nil {
-					ti := res.Request.TraceInfo()
-					fmt.Printf("  Content size  : %v  \n", res.Request.Header["Content-Length"])
-					fmt.Printf("  DNSLookup     : %v  \n", ti.DNSLookup)
-					fmt.Printf("  ConnTime      : %v  \n", ti.ConnTime)
-					fmt.Printf("  TCPConnTime   : %v  \n", ti.TCPConnTime)
-					fmt.Printf("  TLSHandshake  : %v  \n", ti.TLSHandshake)
-					fmt.Printf("  ServerTime    : %v  \n", ti.ServerTime)
-					fmt.Printf("  ResponseTime  : %v \n", ti.ResponseTime)
-					fmt.Printf("  TotalTime     : %v \n", ti.TotalTime)
-					fmt.Printf("  IsConnReused  : %v \n", ti.IsConnReused)
-					fmt.Printf("  IsConnWasIdle : %v \n", ti.IsConnWasIdle)
-					fmt.Printf("  ConnIdleTime  : %v \n", ti.ConnIdleTime)
-					fmt.Printf("  Resp Time       : %v \n", res.Time())
-					fmt.Printf("  Resp Received At: %v \n", res.ReceivedAt())
-				}
-				return true
-			}
-			return false
-		},
-		).EnableTrace().SetContentLength(true).SetRetryWaitTime(1000)
+	policy.apply(argoClient.Client)
+	argoClient.AddRetryCondition(auth.retryOnUnauthorized).EnableTrace().SetContentLength(true)
 
 	argoClientInstance = argoClient
 
@@ -162,6 +191,10 @@ func UnmarshalAndLog(resp *resty.Response, out interface{}, err error) error {
 			return err
 		}
 	}
+	if err := validateStruct(out); err != nil {
+		fmt.Printf("Invalid response from server. Err: %v  \n", err)
+		return err
+	}
 	return nil
 
 }
@@ -174,7 +207,7 @@ func LogResponseErrorOrRequestCreationError(resp *resty.Response, err error) err
 
 	if resp.IsError() {
 		fmt.Printf("Error status from server.\n%v  \n", string(pretty.Color(pretty.Pretty(resp.Body()), nil)))
-		return ErrCodeInResponse
+		return newAPIError(resp)
 	}
 
 	return nil
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// tokenRefreshSkew is how long before expiry a token is proactively refreshed.
+	tokenRefreshSkew = 2 * time.Minute
+)
+
+type authRetriedKey struct{}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// tokenSource hands out a valid access token, refreshing it when it is about
+// to expire. It is safe for concurrent callers; only one refresh runs at a time.
+type tokenSource struct {
+	mu        sync.Mutex
+	key       string
+	secret    string
+	info      *GetClientIDAndSecretResponse
+	expiresAt time.Time
+	rejected  bool
+}
+
+func newTokenSource(key string, secret string) (*tokenSource, error) {
+	if key == "" || secret == "" {
+		return nil, errors.New("access to argonaut server is not configured")
+	}
+	ts := &tokenSource{key: key, secret: secret}
+	if _, err := ts.Token(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (t *tokenSource) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.info != nil && !t.rejected && !t.expiringLocked() {
+		return t.info.Accesstoken, nil
+	}
+	if err := t.refreshLocked(); err != nil {
+		return "", err
+	}
+	return t.info.Accesstoken, nil
+}
+
+// Invalidate marks used as rejected so the next Token call refreshes. Tokens
+// that were already replaced by another caller are ignored.
+func (t *tokenSource) Invalidate(used string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.info != nil && t.info.Accesstoken == used {
+		t.rejected = true
+	}
+}
+
+func (t *tokenSource) expiringLocked() bool {
+	if t.expiresAt.IsZero() {
+		return false
+	}
+	return time.Now().Add(tokenRefreshSkew).After(t.expiresAt)
+}
+
+func (t *tokenSource) refreshLocked() error {
+	var info *GetClientIDAndSecretResponse
+	var err error
+
+	if t.info != nil && t.info.Refreshtoken != "" {
+		info, err = refreshFEAuthInfo(t.info.Refreshtoken)
+		if err != nil {
+			fmt.Printf("Token refresh failed, re-authenticating. Err: %v \n", err)
+		}
+	}
+	if info == nil {
+		info, err = getFEAuthInfo(t.key, t.secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.info = info
+	t.expiresAt = tokenExpiry(info)
+	t.rejected = false
+	return nil
+}
+
+func tokenExpiry(info *GetClientIDAndSecretResponse) time.Time {
+	if info.Expiresin > 0 {
+		return time.Now().Add(time.Duration(info.Expiresin) * time.Second)
+	}
+	for _, layout := range []string{time.RFC3339, time.RFC1123} {
+		if expires, err := time.Parse(layout, info.Expires); err == nil {
+			return expires
+		}
+	}
+	return time.Time{}
+}
+
+func refreshFEAuthInfo(refreshToken string) (*GetClientIDAndSecretResponse, error) {
+	resp, err := resty.New().SetBaseURL(GetFrontEggUrl()).R().
+		SetBody(&refreshTokenRequest{RefreshToken: refreshToken}).
+		Post("/identity/resources/auth/v1/api-token/token/refresh")
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.New("token refresh error : " + string(resp.Body()))
+	}
+
+	var refreshed GetClientIDAndSecretResponse
+	if err := json.Unmarshal(resp.Body(), &refreshed); err != nil {
+		return nil, err
+	}
+	if refreshed.Accesstoken == "" {
+		return nil, errors.New("token refresh returned no access token")
+	}
+
+	fmt.Print("Token refresh successful! \n")
+	return &refreshed, nil
+}
+
+// setAuthHeader sets the current access token on every attempt of a request.
+func (t *tokenSource) setAuthHeader(c *resty.Client, req *resty.Request) error {
+	token, err := t.Token()
+	if err != nil {
+		return err
+	}
+	req.SetHeader("Authorization", token)
+	return nil
+}
+
+// retryOnUnauthorized drops a rejected token and retries the request once with
+// a fresh one.
+func (t *tokenSource) retryOnUnauthorized(res *resty.Response, reqErr error) bool {
+	if res == nil || res.Request == nil || res.StatusCode() != http.StatusUnauthorized {
+		return false
+	}
+	if res.Request.Context().Value(authRetriedKey{}) != nil {
+		return false
+	}
+	fmt.Printf("Access token rejected, refreshing \n")
+	t.Invalidate(res.Request.Header.Get("Authorization"))
+	res.Request.SetContext(context.WithValue(res.Request.Context(), authRetriedKey{}, true))
+	return true
+}
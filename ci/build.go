@@ -4,35 +4,55 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"dagger.io/dagger"
 )
 
-func build(context context.Context, buildRunId string, userRepoLoc string) error {
-
-	fmt.Println("build task started!!")
-
-	callbackPayload := &BuildRunCallbackPayload{
-		Status: Failed,
-	}
+func init() {
+	RegisterTask(TaskDefinition{
+		Prefix:      "br-",
+		Name:        "build",
+		Description: "build a container image and publish it to the configured registry",
+		New:         func() Task { return &buildTask{} },
+	})
+}
 
-	defer GetArgoClient().BuildRunCallback(buildRunId, callbackPayload)
+// buildSpec is everything a build needs, independent of where it was loaded from.
+type buildSpec struct {
+	BuildRun       *BuildRun
+	BuildConfig    *BuildConfig
+	RegistryAccess *RegistryAccess
+	Secrets        []BuildSecret
+}
 
-	shortSha := os.Getenv("SHORT_SHA")
+type buildTask struct {
+	buildRunId      string
+	spec            *buildSpec
+	callbackPayload *BuildRunCallbackPayload
+	progress        *taskProgress
+	stopHeartbeat   func()
+	stopCancelWatch func()
+	logSink         *logSink
+}
 
-	if shortSha == "" {
-		return errors.New("image tag not generated")
+func (t *buildTask) ParseID(taskId string) (string, error) {
+	id, err := trimTaskPrefix(taskId, "br-")
+	t.buildRunId = id
+	t.callbackPayload = &BuildRunCallbackPayload{
+		Status: Failed,
 	}
+	t.progress = newTaskProgress()
+	t.stopHeartbeat = func() {}
+	t.stopCancelWatch = func() {}
+	return id, err
+}
 
-	callbackPayload.ImageTag = fmt.Sprintf("%s-%s", shortSha, time.Now().Format("01020304"))
-
-	fmt.Printf("short sha : [%s]", shortSha)
-
+func (t *buildTask) FetchSpec(ctx context.Context, buildRunId string) error {
 	buildRunInfo, err := GetArgoClient().FetchBuildRunInfo(buildRunId)
 	if err != nil {
 		return err
@@ -46,11 +66,16 @@ func build(context context.Context, buildRunId string, userRepoLoc string) error
 	}
 	fmt.Printf("fetch build info complete : [%v] \n", *buildInfo)
 
-	buildArgs, err := getBuildArgs(buildInfo.Id)
+	if buildInfo.BuildType == "" {
+		buildInfo.BuildType = Docker
+	}
+	t.callbackPayload.BuildType = buildInfo.BuildType
+
+	secrets, err := GetArgoClient().FetchBuildTimeSecrets(buildInfo.Id)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("fetch build args complete : Count[%d] \n", len(buildArgs))
+	fmt.Printf("fetch build args complete : Count[%d] \n", len(secrets.BuildSecretsData.Data))
 
 	crAccess, err := GetArgoClient().FetchContainerRegistryAccess(buildInfo.ArtifactoryId)
 	if err != nil {
@@ -58,37 +83,340 @@ func build(context context.Context, buildRunId string, userRepoLoc string) error
 	}
 	fmt.Printf("cr access call success : [%s]  \n", crAccess.UrlWithPrefix)
 
-	image := fmt.Sprintf("%s/%s", strings.TrimPrefix(crAccess.UrlWithPrefix, "https://"), buildInfo.Name)
-	callbackPayload.Image = image
+	t.spec = &buildSpec{
+		BuildRun:       buildRunInfo,
+		BuildConfig:    buildInfo,
+		RegistryAccess: crAccess,
+		Secrets:        secrets.BuildSecretsData.Data,
+	}
+	return nil
+}
+
+func (t *buildTask) Run(ctx context.Context, opts TaskOptions) error {
+	running := &BuildRunCallbackPayload{
+		BuildType: t.callbackPayload.BuildType,
+		Status:    Running,
+	}
+	if err := GetArgoClient().BuildRunCallback(t.buildRunId, running); err != nil {
+		fmt.Printf("running status callback failed : [%v] \n", err)
+	}
+
+	t.stopHeartbeat = startHeartbeat(ctx, opts.HeartbeatInterval, t.progress, func(step string, elapsed time.Duration) error {
+		return GetArgoClient().BuildRunHeartbeat(t.buildRunId, &BuildRunHeartbeatPayload{
+			Status:         Running,
+			Step:           step,
+			ElapsedSeconds: int64(elapsed.Seconds()),
+		})
+	})
+
+	t.stopCancelWatch = watchRemoteCancel(ctx, t.buildRunId, opts)
+
+	t.logSink = newBuildLogSink(t.buildRunId)
+	opts.LogOutput = io.MultiWriter(opts.logOutput(), t.logSink)
+
+	return runBuild(ctx, t.spec, opts, t.progress, t.callbackPayload)
+}
+
+func (t *buildTask) Report(ctx context.Context, runErr error) error {
+	t.callbackPayload.recordTimings(t.progress)
+	if runErr != nil {
+		t.callbackPayload.Error = runErr.Error()
+	}
+	if reason := cancelReason(ctx); reason != "" && t.callbackPayload.Status != Completed {
+		step, _ := t.progress.Snapshot()
+		t.callbackPayload.Status = Canceled
+		t.callbackPayload.Error = fmt.Sprintf("canceled during step [%s] : %s", step, reason)
+	}
+	t.callbackPayload.IdempotencyKey = newIdempotencyKey()
+
+	// stopping the background loops and flushing logs can take a while, or
+	// never finish when the process is killed, so the outcome is on disk first.
+	// deliverTerminalCallback rewrites the same spool entry.
+	if _, err := spoolCallback("build", t.buildRunId, t.callbackPayload.IdempotencyKey, t.callbackPayload); err != nil {
+		fmt.Printf("callback spool failed : [%v] \n", err)
+	}
+	t.stopHeartbeat()
+	t.stopCancelWatch()
+	if t.logSink != nil {
+		if err := t.logSink.Close(); err != nil {
+			fmt.Printf("log flush failed : [%v] \n", err)
+		}
+		t.callbackPayload.LogChunksDropped = t.logSink.Dropped()
+	}
+	return deliverTerminalCallback("build", t.buildRunId, t.callbackPayload.IdempotencyKey, t.callbackPayload, func() error {
+		return GetArgoClient().BuildRunCallback(t.buildRunId, t.callbackPayload)
+	})
+}
+
+func runBuild(context context.Context, spec *buildSpec, opts TaskOptions, progress *taskProgress, callbackPayload *BuildRunCallbackPayload) error {
+
+	buildInfo := spec.BuildConfig
+	crAccess := spec.RegistryAccess
+
+	progress.Step("read checkout")
+	checkout, err := resolveCheckout(context, opts.UserRepoLoc, spec.BuildRun)
+	if err != nil {
+		return err
+	}
+	callbackPayload.Checkout = checkout
+
+	ociDetails := buildInfo.Details.OCIBuildDetails
+	started := time.Now()
+	vars := tagVariables(spec, checkout, started)
+	tags, err := renderTags(ociDetails.Tags, vars, ociDetails.defaultBranch())
+	if err != nil {
+		return err
+	}
+	labels := imageLabels(spec, checkout, vars, tags, started)
+	callbackPayload.ImageTag = tags[0]
+	callbackPayload.ImageTags = tags
+
+	fmt.Printf("image tags : %v \n", tags)
+
+	signing := ociDetails.Signing
+	signer, err := signingKey(signing, spec.Secrets)
+	if err != nil {
+		if signing.Required {
+			return err
+		}
+		fmt.Printf("image will not be signed : [%v] \n", err)
+	}
+	if signing.Required && (signer == nil || crAccess == nil) {
+		return errors.New("image signing is required but no signing key or registry is configured")
+	}
 
-	execCmd := exec.CommandContext(context, "docker", "login", "--username", crAccess.Username, "--password", crAccess.Password, strings.TrimPrefix(crAccess.Url, "https://"))
-	out, err := execCmd.CombinedOutput()
+	// the signing key is for this runner only and never reaches the build
+	buildSecrets := []BuildSecret{}
+	for _, secret := range spec.Secrets {
+		if signing.KeySecret == "" || secret.Key != signing.KeySecret {
+			buildSecrets = append(buildSecrets, secret)
+		}
+	}
+
+	// the Dockerfile frontend takes no cache volumes, a config asking for them
+	// must not silently run without
+	if buildInfo.BuildType == Docker && !ociDetails.Cache.Disable && len(ociDetails.Cache.Paths) > 0 {
+		return fmt.Errorf("cache.paths %v are only supported for buildpack builds, docker builds cache their layers with --cache-dir; remove them from the docker build config", ociDetails.Cache.Paths)
+	}
+
+	buildArgs, secrets, err := planBuildSecrets(buildInfo.BuildType, ociDetails, buildSecrets)
 	if err != nil {
-		fmt.Printf("docker login failed : [%s]  \n", string(out))
-		return fmt.Errorf(string(out))
+		return err
 	}
 
-	fmt.Printf("docker login complete : [%s] \n", string(out))
+	image := buildInfo.Name
+	if crAccess != nil {
+		image = fmt.Sprintf("%s/%s", strings.TrimPrefix(crAccess.UrlWithPrefix, "https://"), buildInfo.Name)
+	}
+	callbackPayload.Image = image
+
+	// Dockerfile builds keep their layer cache in the engine state
+	if buildInfo.BuildType == Docker && opts.CacheDir != "" && !ociDetails.Cache.Disable {
+		progress.Step("restore engine cache")
+		stopEngine, err := startCachedEngine(context, opts.CacheDir)
+		if err != nil {
+			// the default engine builds just as well, only without the layers of earlier runs
+			fmt.Printf("engine cache unavailable, building cold : [%v] \n", err)
+		} else {
+			// deferred before the client is connected, so it runs after client.Close
+			defer stopEngine()
+		}
+	}
 
 	// initialize Dagger client
-	client, err := dagger.Connect(context, dagger.WithLogOutput(os.Stdout))
+	progress.Step("engine connect")
+	client, err := dagger.Connect(context, dagger.WithLogOutput(opts.logOutput()))
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	//cache := client.CacheVolume("argonaut")
+	workingDir := filepath.Join(opts.UserRepoLoc, buildInfo.Details.OCIBuildDetails.WorkingDir)
 
-	workingDir := filepath.Join(userRepoLoc, buildInfo.Details.OCIBuildDetails.WorkingDir)
-
-	contextDir := client.Host().Directory(workingDir)
+	progress.Step("build")
+	platforms := buildInfo.Details.OCIBuildDetails.Platforms
+	targets := targetPlatforms(platforms)
+	caches := map[dagger.Platform][]*buildCache{}
+	for _, platform := range targets {
+		caches[platform] = planCaches(client, buildInfo, spec.BuildRun.RepoMeta.Branch, platform)
+	}
+	for _, platform := range targets {
+		if err := restoreCaches(context, client, caches[platform], opts.CacheDir); err != nil {
+			return err
+		}
+	}
 
-	ref, err := client.Container().
-		Build(contextDir, dagger.ContainerBuildOpts{Dockerfile: buildInfo.Details.OCIBuildDetails.DockerFilePath, BuildArgs: buildArgs}).
-		Publish(context, fmt.Sprintf("%s:%s", image, callbackPayload.ImageTag))
+	variants, err := buildVariants(context, client, buildInfo, crAccess, workingDir, targets, buildArgs, secrets, caches)
 	if err != nil {
 		return err
 	}
+	for i := range variants {
+		variants[i] = withLabels(variants[i], labels)
+	}
+
+	// the scan gate matches the SBOM inventory, so it needs one even when
+	// no SBOM is attached
+	var sboms []*imageSBOM
+	if !ociDetails.SBOM.Disable || ociDetails.Scan.Enabled {
+		progress.Step("sbom")
+		sboms, err = generateSBOMs(context, client, targets, variants, client.Host().Directory(workingDir))
+		if err != nil {
+			// syft pulls its own image, a registry hiccup must not stop every
+			// build unless the sbom or the scan gate is asked for
+			if ociDetails.SBOM.Required || ociDetails.Scan.Enabled {
+				return err
+			}
+			fmt.Printf("sbom generation failed : [%v] \n", err)
+			callbackPayload.Warnings = append(callbackPayload.Warnings, fmt.Sprintf("sbom : %v", err))
+		}
+	}
+	if !ociDetails.SBOM.Disable && sboms != nil {
+		paths, err := writeSBOMs(sboms, opts.artifactDir())
+		if err != nil {
+			return err
+		}
+		if callbackPayload.SBOM, err = summarizeSBOM(sboms); err != nil {
+			return err
+		}
+		fmt.Printf("sbom written : %v packages : [%d] ecosystems : %v \n", paths, callbackPayload.SBOM.PackageCount, callbackPayload.SBOM.Ecosystems)
+	}
+
+	if ociDetails.Scan.Enabled {
+		progress.Step("vulnerability scan")
+		report, err := scanImages(context, client, sboms, opts.VulnDBPath, ociDetails.Scan)
+		if err != nil {
+			return err
+		}
+		callbackPayload.Scan = report
+		if path, err := writeScanReport(report, opts.artifactDir()); err != nil {
+			fmt.Printf("scan report not written : [%v] \n", err)
+		} else {
+			fmt.Printf("scan report written : [%s] counts : %v \n", path, report.Counts)
+		}
+		if err := report.gateError(); err != nil {
+			return err
+		}
+	}
+
+	// a single image is published as is, several as one manifest list; the
+	// engine builds the variants concurrently when they are exported. The
+	// variants already carry the registry auth from their base container.
+	container := variants[0]
+	var platformVariants []*dagger.Container
+	if len(variants) > 1 {
+		container = client.Container()
+		platformVariants = variants
+	}
+	container = withRegistryAuth(client, container, crAccess)
+
+	if opts.ImageTarball != "" {
+		progress.Step("build and export")
+		if _, err := container.Export(context, opts.ImageTarball, dagger.ContainerExportOpts{PlatformVariants: platformVariants}); err != nil {
+			return err
+		}
+		fmt.Printf("image exported : [%s] \n", opts.ImageTarball)
+	}
+
+	ref := opts.ImageTarball
+	if crAccess != nil {
+		progress.Step("build and publish")
+		for i, tag := range tags {
+			// every tag resolves to the same digest, the first ref is reported
+			published, err := container.Publish(context, fmt.Sprintf("%s:%s", image, tag), dagger.ContainerPublishOpts{PlatformVariants: platformVariants})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("image published : [%s] \n", published)
+			if i == 0 {
+				ref = published
+			}
+		}
+
+		progress.Step("inspect image")
+		_, digest := splitDigest(ref)
+		callbackPayload.Digest = digest
+		if digest != "" {
+			callbackPayload.ImageRef = fmt.Sprintf("%s@%s", image, digest)
+		}
+
+		details, err := describePublishedImage(crAccess, image, digest)
+		if err != nil {
+			// the image is already pushed, missing metadata must not fail the run
+			fmt.Printf("image inspection failed : [%v] \n", err)
+		} else {
+			fmt.Printf("image inspection complete : [%s] \n", details)
+			callbackPayload.ImageSize = details.Size
+			callbackPayload.LayerCount = details.LayerCount
+			callbackPayload.Platforms = details.Platforms
+			callbackPayload.PlatformDigests = details.PlatformDigests
+		}
+	}
+
+	if len(callbackPayload.Platforms) == 0 {
+		callbackPayload.Platforms = platforms
+	}
+	if len(callbackPayload.Platforms) == 0 {
+		if platform, err := variants[0].Platform(context); err == nil {
+			callbackPayload.Platforms = []string{string(platform)}
+		}
+	}
+	if callbackPayload.PlatformDigests == nil && callbackPayload.Digest != "" && len(callbackPayload.Platforms) == 1 {
+		callbackPayload.PlatformDigests = map[string]string{callbackPayload.Platforms[0]: callbackPayload.Digest}
+	}
+
+	if signer != nil && crAccess != nil {
+		progress.Step("sign")
+		signatureRef, err := signImage(crAccess, signer, image, callbackPayload.Digest)
+		if err != nil {
+			if signing.Required {
+				return fmt.Errorf("image signing : %w", err)
+			}
+			fmt.Printf("image signing failed : [%v] \n", err)
+			callbackPayload.Warnings = append(callbackPayload.Warnings, fmt.Sprintf("image signing : %v", err))
+		} else {
+			callbackPayload.SignatureRef = signatureRef
+			fmt.Printf("image signed : [%s] \n", signatureRef)
+		}
+	}
+
+	if !ociDetails.SBOM.Disable && sboms != nil && crAccess != nil && callbackPayload.Digest != "" {
+		progress.Step("attach sbom")
+		// the image is already published under its tags, a missing sbom is
+		// reported but only fails the build when required
+		if err := attachSBOMs(crAccess, image, callbackPayload, sboms); err != nil {
+			if ociDetails.SBOM.Required {
+				return fmt.Errorf("sbom : %w", err)
+			}
+			fmt.Printf("sbom push failed : [%v] \n", err)
+			callbackPayload.Warnings = append(callbackPayload.Warnings, fmt.Sprintf("sbom : %v", err))
+		} else {
+			fmt.Printf("sbom pushed : %v \n", callbackPayload.SBOM.Refs)
+		}
+	}
+
+	if crAccess != nil && callbackPayload.Digest != "" {
+		progress.Step("provenance")
+		if err := attachProvenance(crAccess, spec, checkout, callbackPayload, started, opts.artifactDir()); err != nil {
+			if ociDetails.Provenance.Required {
+				return fmt.Errorf("provenance : %w", err)
+			}
+			fmt.Printf("provenance push failed : [%v] \n", err)
+			callbackPayload.Warnings = append(callbackPayload.Warnings, fmt.Sprintf("provenance : %v", err))
+		}
+	}
+
+	if opts.CacheDir != "" && len(caches[targets[0]]) > 0 {
+		progress.Step("save cache")
+	}
+	for _, platform := range targets {
+		if err := saveCaches(context, client, caches[platform], opts.CacheDir); err != nil {
+			// the image is built, a cache that could not be saved only costs time
+			fmt.Printf("cache save failed : [%v] \n", err)
+		}
+	}
+	if err := pruneCaches(opts.CacheDir, CACHE_MAX_AGE); err != nil {
+		fmt.Printf("cache prune failed : [%v] \n", err)
+	}
 
 	callbackPayload.Status = Completed
 
@@ -97,19 +425,69 @@ func build(context context.Context, buildRunId string, userRepoLoc string) error
 	return nil
 }
 
-func getBuildArgs(buildConfigId string) ([]dagger.BuildArg, error) {
-	res, err := GetArgoClient().FetchBuildTimeSecrets(buildConfigId)
-	if err != nil {
-		return nil, err
+// targetPlatforms converts the configured platforms, with no platforms meaning
+// a single build for the engine's platform.
+func targetPlatforms(platforms []string) []dagger.Platform {
+	if len(platforms) == 0 {
+		return []dagger.Platform{""}
+	}
+	targets := make([]dagger.Platform, len(platforms))
+	for i, platform := range platforms {
+		targets[i] = dagger.Platform(platform)
 	}
-	buildArgs := []dagger.BuildArg{}
-	if res != nil {
-		for _, secret := range res.BuildSecretsData.Data {
-			buildArgs = append(buildArgs, dagger.BuildArg{
-				Name:  secret.Key,
-				Value: secret.Value,
-			})
+	return targets
+}
+
+// buildVariants builds the image once per target platform in parallel.
+func buildVariants(ctx context.Context, client *dagger.Client, buildInfo *BuildConfig, access *RegistryAccess, workingDir string, targets []dagger.Platform, buildArgs []dagger.BuildArg, secrets []buildSecret, caches map[dagger.Platform][]*buildCache) ([]*dagger.Container, error) {
+	variants := make([]*dagger.Container, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, platform := range targets {
+		wg.Add(1)
+		go func(i int, platform dagger.Platform) {
+			defer wg.Done()
+			variants[i], errs[i] = buildContainer(ctx, client, buildInfo, access, workingDir, platform, buildArgs, secrets, caches[platform])
+			if errs[i] != nil && platform != "" {
+				errs[i] = fmt.Errorf("platform [%s] : %w", platform, errs[i])
+			}
+		}(i, platform)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
 		}
 	}
-	return buildArgs, nil
+	return variants, nil
+}
+
+func buildContainer(ctx context.Context, client *dagger.Client, buildInfo *BuildConfig, access *RegistryAccess, workingDir string, platform dagger.Platform, buildArgs []dagger.BuildArg, secrets []buildSecret, caches []*buildCache) (*dagger.Container, error) {
+	switch buildInfo.BuildType {
+	case BuildPack:
+		return buildpackBuild(ctx, client, access, workingDir, platform, buildInfo.Details.OCIBuildDetails, buildArgs, secrets, caches)
+	case Docker:
+		contextDir := client.Host().Directory(workingDir)
+		return baseContainer(client, platform, access).
+			Build(contextDir, dagger.ContainerBuildOpts{
+				Dockerfile: buildInfo.Details.OCIBuildDetails.DockerFilePath,
+				BuildArgs:  buildArgs,
+				Secrets:    dockerBuildSecrets(client, secrets),
+			}), nil
+	default:
+		return nil, fmt.Errorf("unsupported build type : [%s]", buildInfo.BuildType)
+	}
+}
+
+// baseContainer is an empty container for platform that can pull private
+// images, e.g. a Dockerfile FROM or a builder, from the build's registry.
+func baseContainer(client *dagger.Client, platform dagger.Platform, access *RegistryAccess) *dagger.Container {
+	return withRegistryAuth(client, client.Container(dagger.ContainerOpts{Platform: platform}), access)
+}
+
+func (p *BuildRunCallbackPayload) recordTimings(progress *taskProgress) {
+	_, elapsed := progress.Snapshot()
+	p.BuildDurationSeconds = elapsed.Round(time.Millisecond).Seconds()
+	p.StepTimings = progress.Timings()
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	BUILDPACK_BASE_BUILDER = "paketobuildpacks/builder:base"
+	BUILDPACK_FULL_BUILDER = "paketobuildpacks/builder:full"
+	BUILDPACK_RUN_IMAGE    = "paketobuildpacks/run:base-cnb"
+
+	cnbPlatformApi = "0.9"
+	cnbAppDir      = "/workspace"
+	cnbLayersDir   = "/layers"
+	cnbPlatformDir = "/platform"
+	cnbLifecycle   = "/cnb/lifecycle"
+)
+
+var ErrNoBuildpackLanguage = errors.New("no buildpack supported language detected")
+
+// languageMarkers maps a language to the files whose presence identifies it.
+// Order matters: the first language with a matching marker wins.
+var languageMarkers = []struct {
+	language string
+	files    []string
+}{
+	{"go", []string{"go.mod", "Gopkg.toml"}},
+	{"java", []string{"pom.xml", "build.gradle", "build.gradle.kts"}},
+	{"nodejs", []string{"package.json"}},
+	{"python", []string{"requirements.txt", "pyproject.toml", "Pipfile", "setup.py"}},
+	{"ruby", []string{"Gemfile"}},
+	{"php", []string{"composer.json"}},
+	{"dotnet", []string{"*.csproj", "*.fsproj", "*.sln"}},
+}
+
+// builderForLanguage returns the paketo builder that ships buildpacks for language.
+func builderForLanguage(language string) string {
+	switch language {
+	case "python", "php":
+		return BUILDPACK_FULL_BUILDER
+	default:
+		return BUILDPACK_BASE_BUILDER
+	}
+}
+
+func detectLanguage(workingDir string) (string, error) {
+	for _, marker := range languageMarkers {
+		for _, pattern := range marker.files {
+			matches, err := filepath.Glob(filepath.Join(workingDir, pattern))
+			if err != nil {
+				return "", err
+			}
+			if len(matches) > 0 {
+				return marker.language, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w in [%s]", ErrNoBuildpackLanguage, workingDir)
+}
+
+type builderMetadata struct {
+	Stack struct {
+		RunImage struct {
+			Image string `json:"image"`
+		} `json:"runImage"`
+	} `json:"stack"`
+}
+
+// runImageForBuilder reads the run image advertised by the builder, falling back
+// to the paketo base run image when the builder does not declare one.
+func runImageForBuilder(ctx context.Context, builder *dagger.Container) string {
+	label, err := builder.Label(ctx, "io.buildpacks.builder.metadata")
+	if err != nil || label == "" {
+		return BUILDPACK_RUN_IMAGE
+	}
+	metadata := builderMetadata{}
+	if err := json.Unmarshal([]byte(label), &metadata); err != nil || metadata.Stack.RunImage.Image == "" {
+		return BUILDPACK_RUN_IMAGE
+	}
+	return metadata.Stack.RunImage.Image
+}
+
+// buildpackBuild runs the CNB lifecycle detector and builder phases inside the
+// builder image and assembles the resulting layers on top of the run image.
+func buildpackBuild(ctx context.Context, client *dagger.Client, access *RegistryAccess, workingDir string, platform dagger.Platform, details OCIBuildDetails, buildArgs []dagger.BuildArg, secrets []buildSecret, caches []*buildCache) (*dagger.Container, error) {
+
+	if _, err := os.Stat(workingDir); err != nil {
+		return nil, err
+	}
+
+	language, err := detectLanguage(workingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	builderImage := details.Builder
+	if builderImage == "" {
+		builderImage = builderForLanguage(language)
+	}
+
+	fmt.Printf("buildpack detected language : [%s] builder : [%s] \n", language, builderImage)
+
+	builder := baseContainer(client, platform, access).From(builderImage)
+
+	uid, err := builder.EnvVariable(ctx, "CNB_USER_ID")
+	if err != nil {
+		return nil, err
+	}
+	gid, err := builder.EnvVariable(ctx, "CNB_GROUP_ID")
+	if err != nil {
+		return nil, err
+	}
+	if uid == "" || gid == "" {
+		return nil, fmt.Errorf("builder image [%s] does not declare CNB_USER_ID/CNB_GROUP_ID", builderImage)
+	}
+	cnbUser := fmt.Sprintf("%s:%s", uid, gid)
+
+	runImage := details.RunImage
+	if runImage == "" {
+		runImage = runImageForBuilder(ctx, builder)
+	}
+
+	lifecycleArgs := []string{"-app", cnbAppDir, "-layers", cnbLayersDir, "-platform", cnbPlatformDir}
+
+	builder = builder.
+		WithUser("root").
+		WithDirectory(cnbAppDir, client.Host().Directory(workingDir)).
+		WithExec([]string{"mkdir", "-p", cnbLayersDir, filepath.Join(cnbPlatformDir, "env")})
+
+	// build args are exposed to buildpacks as platform environment variables
+	for _, arg := range buildArgs {
+		builder = builder.WithNewFile(filepath.Join(cnbPlatformDir, "env", arg.Name), dagger.ContainerWithNewFileOpts{Contents: arg.Value})
+	}
+
+	for _, cache := range caches {
+		builder = builder.WithMountedCache(cache.Path, cache.Volume)
+	}
+
+	builder = builder.WithExec([]string{"chown", "-R", cnbUser, cnbAppDir, cnbLayersDir, cnbPlatformDir})
+
+	// secrets are mounted after the chown and only reach the builder stage,
+	// which is never part of the image
+	builder = withBuildSecrets(client, builder, cnbUser, filepath.Join(cnbPlatformDir, "env"), secrets)
+
+	builder = builder.
+		WithUser(cnbUser).
+		WithEnvVariable("CNB_PLATFORM_API", cnbPlatformApi).
+		WithExec(append([]string{filepath.Join(cnbLifecycle, "detector")}, lifecycleArgs...)).
+		WithExec(append([]string{filepath.Join(cnbLifecycle, "builder")}, lifecycleArgs...))
+
+	fmt.Printf("buildpack run image : [%s] \n", runImage)
+
+	// like the CNB exporter, only launch layers reach the image, build and
+	// cache layers such as compilers and package caches stay behind
+	layers := builder.Directory(cnbLayersDir)
+	include, err := launchLayerPatterns(ctx, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	return baseContainer(client, platform, access).From(runImage).
+		WithDirectory(cnbLayersDir, layers, dagger.ContainerWithDirectoryOpts{Include: include}).
+		WithDirectory(cnbAppDir, builder.Directory(cnbAppDir)).
+		WithFile(filepath.Join(cnbLifecycle, "launcher"), builder.File(filepath.Join(cnbLifecycle, "launcher"))).
+		WithUser(cnbUser).
+		WithWorkdir(cnbAppDir).
+		WithEnvVariable("CNB_PLATFORM_API", cnbPlatformApi).
+		WithEnvVariable("CNB_APP_DIR", cnbAppDir).
+		WithEnvVariable("CNB_LAYERS_DIR", cnbLayersDir).
+		WithEntrypoint([]string{filepath.Join(cnbLifecycle, "launcher")}), nil
+}
+
+// launchLayerPatterns lists the parts of the layers directory the app needs at
+// runtime: the lifecycle config and every layer whose <layer>.toml sets launch.
+func launchLayerPatterns(ctx context.Context, layers *dagger.Directory) ([]string, error) {
+	include := []string{"config", "config/**"}
+
+	entries, err := layers.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, buildpack := range entries {
+		// top level files such as group.toml and plan.toml are build metadata
+		if buildpack == "config" || buildpack == "sbom" || filepath.Ext(buildpack) != "" {
+			continue
+		}
+		layerEntries, err := layers.Directory(buildpack).Entries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		names := map[string]bool{}
+		for _, name := range layerEntries {
+			names[name] = true
+		}
+		for _, name := range layerEntries {
+			layer := strings.TrimSuffix(name, ".toml")
+			if layer == name || !names[layer] {
+				continue
+			}
+			metadata, err := layers.File(filepath.Join(buildpack, name)).Contents(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if isLaunchLayer(metadata) {
+				path := filepath.Join(buildpack, layer)
+				include = append(include, path, path+"/**", path+".toml")
+			}
+		}
+	}
+	return include, nil
+}
+
+// isLaunchLayer reads the launch flag of a <layer>.toml, under [types] since
+// buildpack API 0.6 and at the top level before.
+func isLaunchLayer(metadata string) bool {
+	section := ""
+	for _, line := range strings.Split(metadata, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[] ")
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) != "launch" {
+			continue
+		}
+		if section == "" || section == "types" {
+			return strings.TrimSpace(value) == "true"
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		want    string
+		wantErr error
+	}{
+		{name: "go module", files: []string{"go.mod", "main.go"}, want: "go"},
+		{name: "gradle kotlin", files: []string{"build.gradle.kts"}, want: "java"},
+		{name: "node", files: []string{"package.json"}, want: "nodejs"},
+		{name: "python project", files: []string{"pyproject.toml"}, want: "python"},
+		{name: "ruby", files: []string{"Gemfile"}, want: "ruby"},
+		{name: "php", files: []string{"composer.json"}, want: "php"},
+		{name: "dotnet project glob", files: []string{"App.csproj"}, want: "dotnet"},
+		{name: "first marker wins", files: []string{"package.json", "requirements.txt"}, want: "nodejs"},
+		{name: "nested markers are ignored", files: []string{"tools/go.mod"}, wantErr: ErrNoBuildpackLanguage},
+		{name: "nothing to build", files: []string{"README.md"}, wantErr: ErrNoBuildpackLanguage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range tt.files {
+				path := filepath.Join(dir, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := detectLanguage(dir)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("detectLanguage() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuilderForLanguage(t *testing.T) {
+	tests := map[string]string{
+		"go":     BUILDPACK_BASE_BUILDER,
+		"java":   BUILDPACK_BASE_BUILDER,
+		"nodejs": BUILDPACK_BASE_BUILDER,
+		"python": BUILDPACK_FULL_BUILDER,
+		"php":    BUILDPACK_FULL_BUILDER,
+	}
+	for language, want := range tests {
+		if got := builderForLanguage(language); got != want {
+			t.Errorf("builderForLanguage(%q) = %q, want %q", language, got, want)
+		}
+	}
+}
+
+func TestIsLaunchLayer(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		want     bool
+	}{
+		{name: "launch type", metadata: "[types]\n  launch = true\n  cache = true\n", want: true},
+		{name: "build only", metadata: "[types]\n  build = true\n  cache = true\n", want: false},
+		{name: "launch false", metadata: "[types]\nlaunch = false\n", want: false},
+		{name: "legacy top level flag", metadata: "launch = true\nbuild = false\n", want: true},
+		{name: "flag in metadata", metadata: "[metadata]\nlaunch = true\n", want: false},
+		{name: "trailing comment", metadata: "[types]\nlaunch = true # needed at runtime\n", want: true},
+		{name: "empty", metadata: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLaunchLayer(tt.metadata); got != tt.want {
+				t.Errorf("isLaunchLayer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
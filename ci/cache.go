@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// CACHE_MAX_AGE is how long a cache tarball that no build used or saved stays
+// in the cache dir.
+const CACHE_MAX_AGE = 7 * 24 * time.Hour
+
+const (
+	cacheMountDir  = "/cache"
+	cacheSeedDir   = "/seed"
+	cacheSeedFile  = "/seed.tar"
+	cacheExportDir = "/export"
+)
+
+var cacheKeyUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// buildCache is a cache volume mounted at Path during the build. The volume is
+// keyed per build config, branch, platform and path; a branch without a cache
+// of its own is seeded from the default branch.
+type buildCache struct {
+	Path     string
+	Key      string
+	Fallback string
+	Volume   *dagger.CacheVolume
+}
+
+// planCaches resolves the configured cache paths into cache volumes for one
+// target platform.
+func planCaches(client *dagger.Client, buildInfo *BuildConfig, branch string, platform dagger.Platform) []*buildCache {
+	config := buildInfo.Details.OCIBuildDetails.Cache
+	if config.Disable || len(config.Paths) == 0 {
+		return nil
+	}
+
+	defaultBranch := config.DefaultBranch
+	if defaultBranch == "" {
+		defaultBranch = buildInfo.Details.OCIBuildDetails.defaultBranch()
+	}
+	if branch == "" {
+		branch = defaultBranch
+	}
+
+	caches := []*buildCache{}
+	for _, path := range config.Paths {
+		key := cacheKey(buildInfo.Id, branch, platform, path)
+		cache := &buildCache{Path: path, Key: key, Volume: client.CacheVolume(key)}
+		if branch != defaultBranch {
+			cache.Fallback = cacheKey(buildInfo.Id, defaultBranch, platform, path)
+		}
+		caches = append(caches, cache)
+	}
+	return caches
+}
+
+func cacheKey(buildConfigId string, branch string, platform dagger.Platform, path string) string {
+	sum := sha256.Sum256([]byte(path))
+	parts := []string{"argonaut", buildConfigId, branch}
+	if platform != "" {
+		parts = append(parts, string(platform))
+	}
+	parts = append(parts, hex.EncodeToString(sum[:4]))
+	return cacheKeyUnsafe.ReplaceAllString(strings.Join(parts, "-"), "-")
+}
+
+// restoreCaches fills every empty volume, first from its tarball in dir and
+// then from the default branch volume, and logs whether the cache was hit.
+// The volumes are made writable for builders that do not run as root.
+func restoreCaches(ctx context.Context, client *dagger.Client, caches []*buildCache, dir string) error {
+	for _, cache := range caches {
+		container := cacheHelper(client, cache)
+
+		seed := cacheTarball(dir, cache.Key)
+		if seed == "" {
+			seed = cacheTarball(dir, cache.Fallback)
+		}
+		if seed != "" {
+			container = container.WithMountedFile(cacheSeedFile, client.Host().Directory(filepath.Dir(seed)).File(filepath.Base(seed)))
+			// a used tarball counts as fresh for pruneCaches
+			now := time.Now()
+			if err := os.Chtimes(seed, now, now); err != nil {
+				fmt.Printf("cache [%s] : [%v] \n", seed, err)
+			}
+		}
+		if cache.Fallback != "" {
+			container = container.WithMountedCache(cacheSeedDir, client.CacheVolume(cache.Fallback))
+		}
+
+		script := fmt.Sprintf(`set -e
+if [ -n "$(ls -A %[1]s)" ]; then state=hit
+elif [ -f %[2]s ]; then tar -xf %[2]s -C %[1]s; state=restored
+elif [ -d %[3]s ] && [ -n "$(ls -A %[3]s)" ]; then cp -a %[3]s/. %[1]s/; state=fallback
+else state=miss; fi
+chmod -R a+rwX %[1]s
+echo "$state $(du -sk %[1]s | cut -f1) $(find %[1]s -mindepth 1 | wc -l)"`, cacheMountDir, cacheSeedFile, cacheSeedDir)
+
+		out, err := container.WithExec([]string{"sh", "-c", script}).Stdout(ctx)
+		if err != nil {
+			return fmt.Errorf("cache restore [%s] : %w", cache.Path, err)
+		}
+		state, size, entries := parseCacheStats(out)
+		fmt.Printf("cache [%s] key [%s] : %s, %s KiB in %s entries \n", cache.Path, cache.Key, state, size, entries)
+	}
+	return nil
+}
+
+// saveCaches writes every volume to a tarball in dir so it can be persisted
+// between runs and restored by restoreCaches.
+func saveCaches(ctx context.Context, client *dagger.Client, caches []*buildCache, dir string) error {
+	if dir == "" || len(caches) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, cache := range caches {
+		archive := filepath.Join(cacheExportDir, cache.Key+".tar")
+		script := fmt.Sprintf(`set -e
+mkdir -p %[1]s
+tar -cf %[2]s -C %[3]s .
+echo "saved $(du -sk %[3]s | cut -f1) $(find %[3]s -mindepth 1 | wc -l)"`, cacheExportDir, archive, cacheMountDir)
+
+		container := cacheHelper(client, cache).
+			WithExec([]string{"sh", "-c", script})
+		out, err := container.Stdout(ctx)
+		if err != nil {
+			return fmt.Errorf("cache save [%s] : %w", cache.Path, err)
+		}
+
+		target := filepath.Join(dir, cache.Key+".tar")
+		if _, err := container.File(archive).Export(ctx, target); err != nil {
+			return fmt.Errorf("cache save [%s] : %w", cache.Path, err)
+		}
+		_, size, entries := parseCacheStats(out)
+		fmt.Printf("cache [%s] saved to [%s] : %s KiB in %s entries \n", cache.Path, target, size, entries)
+	}
+	return nil
+}
+
+// pruneCaches removes the tarballs in dir that were neither saved nor restored
+// within maxAge, e.g. those of deleted branches, so the persisted cache dir
+// does not grow with every branch.
+func pruneCaches(dir string, maxAge time.Duration) error {
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	var freed int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "argonaut-") || !strings.HasSuffix(entry.Name(), ".tar") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+	}
+	if removed > 0 {
+		fmt.Printf("cache prune : removed %d tarballs unused for %s, %d KiB \n", removed, maxAge, freed/1024)
+	}
+	return nil
+}
+
+// cacheHelper mounts the volume in a small utility container. The run marker
+// keeps the engine from answering with a cached result, since the contents of
+// a volume are not part of the cache key.
+func cacheHelper(client *dagger.Client, cache *buildCache) *dagger.Container {
+	return client.Container().From(CACHE_HELPER_IMAGE).
+		WithEnvVariable("ARGONAUT_CACHE_RUN", strconv.FormatInt(time.Now().UnixNano(), 10)).
+		WithMountedCache(cacheMountDir, cache.Volume)
+}
+
+// cacheTarball returns the saved tarball for key in dir, or "" when there is none.
+func cacheTarball(dir string, key string) string {
+	if dir == "" || key == "" {
+		return ""
+	}
+	path := filepath.Join(dir, key+".tar")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func parseCacheStats(out string) (string, string, string) {
+	fields := strings.Fields(out)
+	for len(fields) < 3 {
+		fields = append(fields, "?")
+	}
+	n := len(fields)
+	return fields[n-3], fields[n-2], fields[n-1]
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	callbackSpoolMaxAge  = 7 * 24 * time.Hour
+	callbackSpoolDirName = "argonaut-callbacks"
+)
+
+// spooledCallback is a terminal callback persisted to disk until midgard
+// acknowledges it.
+type spooledCallback struct {
+	Kind           string          `json:"kind"`
+	RunId          string          `json:"run_id"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	Payload        json.RawMessage `json:"payload"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// callbackSenders replays a spooled payload of the given kind.
+var callbackSenders = map[string]func(runId string, payload json.RawMessage) error{
+	"build": func(runId string, payload json.RawMessage) error {
+		out := BuildRunCallbackPayload{}
+		if err := json.Unmarshal(payload, &out); err != nil {
+			return err
+		}
+		return GetArgoClient().BuildRunCallback(runId, &out)
+	},
+	"deploy": func(runId string, payload json.RawMessage) error {
+		out := DeployRunCallbackPayload{}
+		if err := json.Unmarshal(payload, &out); err != nil {
+			return err
+		}
+		return GetArgoClient().DeployRunCallback(runId, &out)
+	},
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func callbackSpoolDir() string {
+	if dir := os.Getenv("ARGONAUT_SPOOL_DIR"); dir != "" {
+		return dir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, callbackSpoolDirName)
+	}
+	return filepath.Join(os.TempDir(), callbackSpoolDirName)
+}
+
+// deliverTerminalCallback spools the callback before sending it, so a crash or
+// an unreachable backend leaves a record that the next invocation replays.
+// The spool entry is removed once the backend accepts the callback.
+func deliverTerminalCallback(kind string, runId string, idempotencyKey string, payload interface{}, send func() error) error {
+	spoolPath, spoolErr := spoolCallback(kind, runId, idempotencyKey, payload)
+	if spoolErr != nil {
+		fmt.Printf("callback spool failed : [%v] \n", spoolErr)
+	}
+
+	// the client retries the request within its retry budget, callbacks carry
+	// an idempotency key so that is safe
+	err := send()
+	if err != nil && spoolErr == nil {
+		if rejectedCallback(err) {
+			fmt.Printf("%s callback rejected, not spooling it for replay : [%v] \n", kind, err)
+			os.Remove(spoolPath)
+		} else {
+			fmt.Printf("%s callback failed, spooled to [%s] for replay : [%v] \n", kind, spoolPath, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if spoolErr == nil {
+		if err := os.Remove(spoolPath); err != nil {
+			fmt.Printf("callback spool cleanup failed : [%v] \n", err)
+		}
+	}
+	return nil
+}
+
+// rejectedCallback reports whether the backend refused the callback itself,
+// e.g. a 400, 404 or 409, so sending it again cannot succeed. Rejected
+// credentials are not the callback's fault and keep it spooled.
+func rejectedCallback(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && !apiErr.IsRetryable() && !apiErr.IsAuth()
+}
+
+func spoolCallback(kind string, runId string, idempotencyKey string, payload interface{}) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	record, err := json.Marshal(spooledCallback{
+		Kind:           kind,
+		RunId:          runId,
+		IdempotencyKey: idempotencyKey,
+		Payload:        body,
+		CreatedAt:      time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	dir := callbackSpoolDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.json", kind, runId, idempotencyKey))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, record, 0600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// replaySpooledCallbacks sends every spooled callback once, oldest first.
+// Delivered and expired records are removed; failures stay for the next run.
+func replaySpooledCallbacks() (int, error) {
+	dir := callbackSpoolDir()
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	records := []spooledCallback{}
+	paths := map[string]string{}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("could not read spooled callback [%s] : [%v] \n", name, err)
+			continue
+		}
+		record := spooledCallback{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			fmt.Printf("discarding unreadable spooled callback [%s] : [%v] \n", name, err)
+			os.Remove(path)
+			continue
+		}
+		records = append(records, record)
+		paths[record.IdempotencyKey] = path
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	delivered := 0
+	failed := 0
+	for _, record := range records {
+		path := paths[record.IdempotencyKey]
+		if time.Since(record.CreatedAt) > callbackSpoolMaxAge {
+			fmt.Printf("discarding expired spooled callback [%s] \n", filepath.Base(path))
+			os.Remove(path)
+			continue
+		}
+		send, ok := callbackSenders[record.Kind]
+		if !ok {
+			fmt.Printf("skipping spooled callback of unknown kind [%s] \n", record.Kind)
+			continue
+		}
+		if err := send(record.RunId, record.Payload); err != nil {
+			if rejectedCallback(err) {
+				fmt.Printf("discarding spooled %s callback for [%s], the backend rejected it : [%v] \n", record.Kind, record.RunId, err)
+				os.Remove(path)
+				continue
+			}
+			fmt.Printf("spooled %s callback for [%s] failed : [%v] \n", record.Kind, record.RunId, err)
+			failed++
+			continue
+		}
+		os.Remove(path)
+		delivered++
+		fmt.Printf("spooled %s callback for [%s] delivered \n", record.Kind, record.RunId)
+	}
+
+	if failed > 0 {
+		return delivered, fmt.Errorf("%d spooled callbacks could not be delivered", failed)
+	}
+	return delivered, nil
+}
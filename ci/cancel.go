@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+type cancellationKey struct{}
+
+// cancellation is a context cancel function that remembers why it was called,
+// so the terminal callback can say what stopped the task.
+type cancellation struct {
+	mu     sync.Mutex
+	reason string
+	cancel context.CancelFunc
+}
+
+func withCancellation(parent context.Context) (context.Context, *cancellation) {
+	ctx, cancel := context.WithCancel(parent)
+	c := &cancellation{cancel: cancel}
+	return context.WithValue(ctx, cancellationKey{}, c), c
+}
+
+func cancellationFrom(ctx context.Context) *cancellation {
+	c, _ := ctx.Value(cancellationKey{}).(*cancellation)
+	return c
+}
+
+// Cancel cancels the context. Only the first reason is kept.
+func (c *cancellation) Cancel(reason string) {
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+func (c *cancellation) Reason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+// cancelReason reports why ctx was canceled, or "" if it is still live.
+func cancelReason(ctx context.Context) string {
+	if ctx.Err() == nil {
+		return ""
+	}
+	if c := cancellationFrom(ctx); c != nil && c.Reason() != "" {
+		return c.Reason()
+	}
+	return ctx.Err().Error()
+}
+
+// handleSignals cancels the context on the first SIGINT/SIGTERM so the running
+// task can report Canceled, and exits immediately on the second.
+func handleSignals(c *cancellation) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("received %s, canceling task \n", sig)
+		c.Cancel(fmt.Sprintf("received %s", sig))
+
+		sig = <-signals
+		fmt.Printf("received %s again, exiting \n", sig)
+		os.Exit(130)
+	}()
+}
+
+// watchRemoteCancel polls the build run on midgard and cancels ctx once the
+// run was canceled from the argonaut ui.
+func watchRemoteCancel(ctx context.Context, buildRunId string, opts TaskOptions) func() {
+	c := cancellationFrom(ctx)
+	if c == nil {
+		return func() {}
+	}
+	return startPeriodic(ctx, opts.CancelPollInterval, func() {
+		status, err := GetArgoClient().FetchBuildRunStatus(buildRunId)
+		if err != nil {
+			fmt.Printf("cancel poll failed : [%v] \n", err)
+			return
+		}
+		if status == Canceled {
+			fmt.Printf("build run canceled from argonaut \n")
+			c.Cancel("canceled from argonaut")
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var hexRef = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// readCheckout inspects the git checkout at repo.
+func readCheckout(ctx context.Context, repo string) (*RepoCheckout, error) {
+	git := func(args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, "git", append([]string{"-C", repo}, args...)...).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	sha, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("[%s] is not a git checkout : %w", repo, err)
+	}
+	checkout := &RepoCheckout{CommitSha: sha}
+
+	// detached checkouts of a tag or sha have no branch, and untagged commits no tag
+	checkout.Branch, _ = git("symbolic-ref", "--short", "-q", "HEAD")
+	checkout.Tag, _ = git("describe", "--tags", "--exact-match", "HEAD")
+	if remote, err := git("remote", "get-url", "origin"); err == nil {
+		checkout.Remote = publicRemote(remote)
+	}
+
+	if checkout.Message, err = git("log", "-1", "--format=%B"); err != nil {
+		return nil, err
+	}
+	if checkout.Author, err = git("log", "-1", "--format=%an <%ae>"); err != nil {
+		return nil, err
+	}
+	committed, err := git("log", "-1", "--format=%cI")
+	if err != nil {
+		return nil, err
+	}
+	if checkout.CommittedAt, err = time.Parse(time.RFC3339, committed); err != nil {
+		return nil, fmt.Errorf("commit time [%s] : %w", committed, err)
+	}
+
+	status, err := git("status", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	checkout.Dirty = status != ""
+
+	submodules, err := git("submodule", "status", "--recursive")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(submodules, "\n") {
+		// lines look like "+<sha> <path> (<describe>)", the first column is a state marker
+		fields := strings.Fields(strings.TrimLeft(line, " +-U"))
+		if len(fields) < 2 {
+			continue
+		}
+		if checkout.Submodules == nil {
+			checkout.Submodules = map[string]string{}
+		}
+		checkout.Submodules[fields[1]] = fields[0]
+	}
+	return checkout, nil
+}
+
+// matchesRef reports whether ref, a branch, tag or commit sha as requested by
+// argonaut, names the checked out commit.
+func (c *RepoCheckout) matchesRef(ctx context.Context, repo string, ref string) bool {
+	ref = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	if hexRef.MatchString(ref) && strings.HasPrefix(c.CommitSha, ref) {
+		return true
+	}
+	if ref == c.Branch || ref == c.Tag {
+		return true
+	}
+
+	// other refs, e.g. a pull request ref, are resolved in the checkout
+	for _, candidate := range []string{ref, "origin/" + ref, "refs/remotes/" + strings.TrimPrefix(ref, "refs/")} {
+		out, err := exec.CommandContext(ctx, "git", "-C", repo, "rev-parse", "--verify", "--quiet", candidate+"^{commit}").Output()
+		if err == nil && strings.TrimSpace(string(out)) == c.CommitSha {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCheckout verifies that the checkout at repo is what buildRun asked
+// for and fills the build run's repo metadata from it. A build run without a
+// requested ref may run outside a git checkout, e.g. a local build.
+func resolveCheckout(ctx context.Context, repo string, buildRun *BuildRun) (*RepoCheckout, error) {
+	checkout, err := readCheckout(ctx, repo)
+	if err != nil {
+		if buildRun.CIRef == "" && buildRun.RepoMeta.CommitSha == "" {
+			fmt.Printf("repository metadata unavailable : [%v] \n", err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	fmt.Printf("checkout : commit [%s] branch [%s] tag [%s] dirty [%t] submodules [%d] \n", checkout.CommitSha, checkout.Branch, checkout.Tag, checkout.Dirty, len(checkout.Submodules))
+
+	if buildRun.CIRef != "" && !checkout.matchesRef(ctx, repo, buildRun.CIRef) {
+		return nil, fmt.Errorf("checked out commit [%s] (branch [%s] tag [%s]) is not the requested ref [%s]", checkout.CommitSha, checkout.Branch, checkout.Tag, buildRun.CIRef)
+	}
+	if expected := buildRun.RepoMeta.CommitSha; expected != "" && !strings.HasPrefix(checkout.CommitSha, expected) {
+		return nil, fmt.Errorf("checked out commit [%s] is not the requested commit [%s]", checkout.CommitSha, expected)
+	}
+	if checkout.Dirty {
+		fmt.Printf("warning : the checkout has uncommitted changes, the image will not match commit [%s] \n", checkout.CommitSha)
+	}
+
+	meta := &buildRun.RepoMeta
+	meta.CommitSha = checkout.CommitSha
+	meta.Message = checkout.Message
+	meta.Username = checkout.Author
+	if checkout.Branch != "" {
+		meta.Branch = checkout.Branch
+	}
+	return checkout, nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is stamped at release time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+type command struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     func(ctx context.Context, cmd *command, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func registerCommand(cmd *command) {
+	commands[cmd.Name] = cmd
+}
+
+func init() {
+	registerCommand(&command{Name: "run", Args: "<task-id>", Summary: "run an argonaut task (see `ci tasks list` for supported task ids)", Run: runCommand})
+	registerCommand(&command{Name: "build", Summary: "run the build task for an argonaut build run", Run: buildCommand})
+	registerCommand(&command{Name: "validate", Summary: "check credentials, repository location and task spec without running the task", Run: validateCommand})
+	registerCommand(&command{Name: "version", Summary: "print version information", Run: versionCommand})
+	registerCommand(&command{Name: "flush-callbacks", Summary: "replay terminal callbacks spooled after a failed delivery", Run: flushCallbacksCommand})
+	registerCommand(&command{Name: "tasks", Args: "list", Summary: "list the task types supported by this binary", Run: tasksCommand})
+}
+
+// cliFlags wraps a flag set so string flags can fall back to environment
+// variables without leaking their values into --help output.
+type cliFlags struct {
+	*flag.FlagSet
+	envs map[string]string
+}
+
+func newCLIFlags(cmd *command) *cliFlags {
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ci %s [flags] %s\n\n%s\n\nflags:\n", cmd.Name, cmd.Args, cmd.Summary)
+		fs.PrintDefaults()
+	}
+	return &cliFlags{FlagSet: fs, envs: map[string]string{}}
+}
+
+func (f *cliFlags) StringEnv(name string, env string, usage string) *string {
+	if env != "" {
+		usage = fmt.Sprintf("%s (env %s)", usage, env)
+		f.envs[name] = env
+	}
+	return f.String(name, "", usage)
+}
+
+func (f *cliFlags) Parse(args []string) error {
+	if err := f.FlagSet.Parse(args); err != nil {
+		return err
+	}
+	for name, env := range f.envs {
+		if f.Lookup(name).Value.String() == "" {
+			if err := f.Set(name, os.Getenv(env)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Require reports every listed flag that is still empty after env fallbacks.
+func (f *cliFlags) Require(names ...string) error {
+	missing := []string{}
+	for _, name := range names {
+		if f.Lookup(name).Value.String() != "" {
+			continue
+		}
+		if env, ok := f.envs[name]; ok {
+			missing = append(missing, fmt.Sprintf("--%s (or %s)", name, env))
+		} else {
+			missing = append(missing, "--"+name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required input : %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+type credentialFlags struct {
+	authKey        *string
+	authSecret     *string
+	retryAttempts  *string
+	retryBaseDelay *string
+	retryMaxDelay  *string
+	retryBudget    *string
+}
+
+func addCredentialFlags(f *cliFlags) credentialFlags {
+	return credentialFlags{
+		authKey:        f.StringEnv("auth-key", "ARG_AUTH_KEY", "argonaut auth key/clientId"),
+		authSecret:     f.StringEnv("auth-secret", "ARG_AUTH_SECRET", "argonaut auth pass/secret"),
+		retryAttempts:  f.StringEnv("retry-attempts", "ARGONAUT_RETRY_ATTEMPTS", fmt.Sprintf("attempts per argonaut request, 1 disables retries; a rejected token is still refreshed once (default %d)", DEFAULT_RETRY_ATTEMPTS)),
+		retryBaseDelay: f.StringEnv("retry-base-delay", "ARGONAUT_RETRY_BASE_DELAY", "first backoff between attempts, doubled after each one (default "+DEFAULT_RETRY_BASE_DELAY.String()+")"),
+		retryMaxDelay:  f.StringEnv("retry-max-delay", "ARGONAUT_RETRY_MAX_DELAY", "longest backoff between attempts, also caps Retry-After (default "+DEFAULT_RETRY_MAX_DELAY.String()+")"),
+		retryBudget:    f.StringEnv("retry-budget", "ARGONAUT_RETRY_BUDGET", "time after which a request is no longer retried, 0 for no limit (default "+DEFAULT_RETRY_BUDGET.String()+")"),
+	}
+}
+
+func (c credentialFlags) retryPolicy() (RetryPolicy, error) {
+	policy := defaultRetryPolicy()
+	if *c.retryAttempts != "" {
+		attempts, err := strconv.Atoi(*c.retryAttempts)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("invalid --retry-attempts [%s], expected a number of at least 1", *c.retryAttempts)
+		}
+		policy.Attempts = attempts
+	}
+	durations := []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"retry-base-delay", *c.retryBaseDelay, &policy.BaseDelay},
+		{"retry-max-delay", *c.retryMaxDelay, &policy.MaxDelay},
+		{"retry-budget", *c.retryBudget, &policy.Budget},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(duration.value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid --%s : %w", duration.name, err)
+		}
+		*duration.out = d
+	}
+	if policy.BaseDelay <= 0 {
+		return policy, fmt.Errorf("invalid --retry-base-delay [%s], expected a positive duration", policy.BaseDelay)
+	}
+	if policy.MaxDelay < policy.BaseDelay {
+		return policy, fmt.Errorf("--retry-max-delay [%s] is shorter than --retry-base-delay [%s]", policy.MaxDelay, policy.BaseDelay)
+	}
+	return policy, nil
+}
+
+type taskOptionFlags struct {
+	repo               *string
+	heartbeatInterval  *string
+	cancelPollInterval *string
+	cacheDir           *string
+	artifactDir        *string
+	vulnDB             *string
+}
+
+func addTaskOptionFlags(f *cliFlags) taskOptionFlags {
+	return taskOptionFlags{
+		repo:               f.StringEnv("repo", "ARGONAUT_REPO_DIR", "location of the checked out user repository"),
+		heartbeatInterval:  f.StringEnv("heartbeat-interval", "ARGONAUT_HEARTBEAT_INTERVAL", "interval between progress heartbeats, 0 disables them (default 30s)"),
+		cancelPollInterval: f.StringEnv("cancel-poll-interval", "ARGONAUT_CANCEL_POLL_INTERVAL", "interval between checks for a cancel from argonaut, 0 disables them (default 15s)"),
+		cacheDir:           f.StringEnv("cache-dir", "ARGONAUT_CACHE_DIR", "directory build caches are restored from and saved to"),
+		vulnDB:             f.StringEnv("vuln-db", "ARGONAUT_VULN_DB", "offline grype vulnerability database, a directory or archive, used by the scan gate"),
+		artifactDir:        f.StringEnv("artifact-dir", "ARGONAUT_ARTIFACT_DIR", "directory provenance and other build documents are written to (default "+DEFAULT_ARTIFACT_DIR+")"),
+	}
+}
+
+func (t taskOptionFlags) options() (TaskOptions, error) {
+	opts := TaskOptions{
+		UserRepoLoc:        *t.repo,
+		CacheDir:           *t.cacheDir,
+		ArtifactDir:        *t.artifactDir,
+		VulnDBPath:         *t.vulnDB,
+		HeartbeatInterval:  DEFAULT_HEARTBEAT_INTERVAL,
+		CancelPollInterval: DEFAULT_CANCEL_POLL_INTERVAL,
+	}
+	intervals := []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"heartbeat-interval", *t.heartbeatInterval, &opts.HeartbeatInterval},
+		{"cancel-poll-interval", *t.cancelPollInterval, &opts.CancelPollInterval},
+	}
+	for _, interval := range intervals {
+		if interval.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(interval.value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --%s : %w", interval.name, err)
+		}
+		*interval.out = d
+	}
+	return opts, nil
+}
+
+func runCLI(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		// older workflows invoke the binary as `ci <task-id> <repo>`
+		if _, err := LookupTask(args[0]); err == nil && len(args) == 2 {
+			fmt.Println("positional arguments are deprecated, use `ci run --repo <repo> <task-id>`")
+			return runCommand(ctx, commands["run"], []string{"--repo", args[1], args[0]})
+		}
+		printUsage()
+		return fmt.Errorf("unknown command : [%s]", args[0])
+	}
+
+	err := cmd.Run(ctx, cmd, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("usage: ci <command> [flags] [args]")
+	fmt.Println()
+	fmt.Println("commands:")
+	for _, name := range names {
+		fmt.Printf("  %-16s %s\n", name, commands[name].Summary)
+	}
+	fmt.Println()
+	fmt.Println("run `ci <command> --help` for the flags of a command")
+}
+
+func setupArgoClient(creds credentialFlags) error {
+	policy, err := creds.retryPolicy()
+	if err != nil {
+		return err
+	}
+	_, err = InitializeArgoClient(*creds.authKey, *creds.authSecret, policy)
+	if err != nil {
+		fmt.Printf("Argonaut client setup failed : [%v] \n", err)
+		return err
+	}
+	fmt.Printf("Argonaut client setup complete! \n")
+	return nil
+}
+
+func checkRepoDir(userRepoLoc string) error {
+	info, err := os.Stat(userRepoLoc)
+	if err != nil {
+		return fmt.Errorf("user repo location is not accessible : %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("user repo location is not a directory : [%s]", userRepoLoc)
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	creds := addCredentialFlags(f)
+	taskFlags := addTaskOptionFlags(f)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		return errors.New("exactly one task id is required")
+	}
+	opts, err := taskFlags.options()
+	if err != nil {
+		return err
+	}
+	return executeTask(ctx, f, creds, f.Arg(0), opts)
+}
+
+func buildCommand(ctx context.Context, cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	creds := addCredentialFlags(f)
+	taskFlags := addTaskOptionFlags(f)
+	buildRunId := f.StringEnv("build-run-id", "ARGONAUT_BUILD_RUN_ID", "argonaut build run identifier")
+	local := f.Bool("local", false, "build from --config without contacting the argonaut backend")
+	config := f.String("config", "", "local build document (build_config, build_run, registry_access, secrets) in yaml or json")
+	output := f.String("output", "", "also export the built image as an OCI tarball to this path")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	opts, err := taskFlags.options()
+	if err != nil {
+		return err
+	}
+	opts.ImageTarball = *output
+
+	if *local {
+		if err := f.Require("config"); err != nil {
+			return err
+		}
+		if opts.UserRepoLoc == "" {
+			opts.UserRepoLoc = "."
+		}
+		if err := checkRepoDir(opts.UserRepoLoc); err != nil {
+			return err
+		}
+		return runLocalBuild(ctx, *config, opts)
+	}
+
+	if err := f.Require("build-run-id"); err != nil {
+		return err
+	}
+	taskId := "br-" + strings.TrimPrefix(*buildRunId, "br-")
+	return executeTask(ctx, f, creds, taskId, opts)
+}
+
+func executeTask(ctx context.Context, f *cliFlags, creds credentialFlags, taskId string, opts TaskOptions) error {
+
+	fmt.Println("ci process started")
+
+	if err := f.Require("repo", "auth-key", "auth-secret"); err != nil {
+		return err
+	}
+	if err := checkRepoDir(opts.UserRepoLoc); err != nil {
+		return err
+	}
+	if _, err := LookupTask(taskId); err != nil {
+		return err
+	}
+
+	fmt.Printf("taskId [%s] userRepoLoc [%s] \n", taskId, opts.UserRepoLoc)
+
+	if err := setupArgoClient(creds); err != nil {
+		return err
+	}
+
+	if _, err := replaySpooledCallbacks(); err != nil {
+		fmt.Printf("spooled callback replay incomplete : [%v] \n", err)
+	}
+
+	return runTask(ctx, taskId, opts)
+}
+
+func flushCallbacksCommand(ctx context.Context, cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	creds := addCredentialFlags(f)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if err := f.Require("auth-key", "auth-secret"); err != nil {
+		return err
+	}
+	if err := setupArgoClient(creds); err != nil {
+		return err
+	}
+
+	fmt.Printf("replaying callbacks spooled in [%s] \n", callbackSpoolDir())
+	delivered, err := replaySpooledCallbacks()
+	fmt.Printf("delivered %d spooled callbacks \n", delivered)
+	return err
+}
+
+func validateCommand(ctx context.Context, cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	creds := addCredentialFlags(f)
+	repo := f.StringEnv("repo", "ARGONAUT_REPO_DIR", "location of the checked out user repository")
+	taskId := f.String("task-id", "", "also fetch and check the spec of this task")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if err := f.Require("auth-key", "auth-secret"); err != nil {
+		return err
+	}
+
+	if *repo != "" {
+		if err := checkRepoDir(*repo); err != nil {
+			return err
+		}
+		fmt.Printf("user repo location ok : [%s] \n", *repo)
+	}
+
+	if err := setupArgoClient(creds); err != nil {
+		return err
+	}
+
+	if *taskId == "" {
+		return nil
+	}
+
+	def, err := LookupTask(*taskId)
+	if err != nil {
+		return err
+	}
+	task := def.New()
+	id, err := task.ParseID(*taskId)
+	if err != nil {
+		return err
+	}
+	if err := task.FetchSpec(ctx, id); err != nil {
+		return err
+	}
+	fmt.Printf("%s task spec ok : [%s] \n", def.Name, *taskId)
+	return nil
+}
+
+func versionCommand(ctx context.Context, cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Printf("ci version %s (revision %s, %s %s/%s)\n", version, buildRevision(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// buildRevision is the vcs revision this binary was built from.
+func buildRevision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+func tasksCommand(ctx context.Context, cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 1 || f.Arg(0) != "list" {
+		f.Usage()
+		return errors.New("expected subcommand : list")
+	}
+	printTasks()
+	return nil
+}
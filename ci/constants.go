@@ -1,12 +1,22 @@
 package main
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 const (
 	MIDGARD_URL  = "https://midgard.argonaut.dev"
 	FRONTEGG_URL = "https://argonaut.frontegg.com"
 )
 
+const (
+	DEFAULT_HEARTBEAT_INTERVAL   = 30 * time.Second
+	DEFAULT_CANCEL_POLL_INTERVAL = 15 * time.Second
+)
+
+const DEFAULT_ARTIFACT_DIR = "argonaut-artifacts"
+
 type BuildType string
 
 const (
@@ -31,6 +41,37 @@ const (
 	Completed BuildRunStatus = "completed"
 )
 
+type ManifestType string
+
+const (
+	Helm      ManifestType = "helm"
+	Kustomize ManifestType = "kustomize"
+)
+
+type DeployStrategy string
+
+const (
+	Apply  DeployStrategy = "apply"
+	Commit DeployStrategy = "commit"
+)
+
+type SecretMode string
+
+const (
+	SecretBuildArg SecretMode = "build_arg" // plain build arg, only for non-sensitive values, never a default
+	SecretEnv      SecretMode = "env"
+	SecretFile     SecretMode = "file"
+)
+
+const (
+	HELM_IMAGE         = "alpine/helm:3.11.1"
+	KUSTOMIZE_IMAGE    = "registry.k8s.io/kustomize/kustomize:v5.0.1"
+	KUBECTL_IMAGE      = "bitnami/kubectl:1.26"
+	CACHE_HELPER_IMAGE = "alpine:3.17"
+	SYFT_IMAGE         = "anchore/syft:v0.75.0"
+	GRYPE_IMAGE        = "anchore/grype:v0.59.1"
+)
+
 func GetMidgardUrl() string {
 	host := os.Getenv("ARGONAUT_BACKEND")
 	if host == "" {
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	manifestMountDir  = "/manifests"
+	kubeconfigPath    = "/run/secrets/kubeconfig"
+	defaultValuesFile = "values.yaml"
+)
+
+func init() {
+	RegisterTask(TaskDefinition{
+		Prefix:      "dr-",
+		Name:        "deploy",
+		Description: "render manifests with a built image and apply or commit them",
+		New:         func() Task { return &deployTask{} },
+	})
+}
+
+type deployTask struct {
+	deployRunId     string
+	deployRun       *DeployRun
+	buildRun        *BuildRun
+	callbackPayload *DeployRunCallbackPayload
+}
+
+func (t *deployTask) ParseID(taskId string) (string, error) {
+	id, err := trimTaskPrefix(taskId, "dr-")
+	t.deployRunId = id
+	t.callbackPayload = &DeployRunCallbackPayload{
+		Status: Failed,
+	}
+	return id, err
+}
+
+func (t *deployTask) FetchSpec(ctx context.Context, deployRunId string) error {
+	deployRunInfo, err := GetArgoClient().FetchDeployRunInfo(deployRunId)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("fetch deploy run info complete : [%v] \n", *deployRunInfo)
+
+	buildRunInfo, err := GetArgoClient().FetchBuildRunInfo(deployRunInfo.BuildRunId)
+	if err != nil {
+		return err
+	}
+	if buildRunInfo.Status != Completed {
+		return fmt.Errorf("build run [%s] is not completed : [%s]", buildRunInfo.Id, buildRunInfo.Status)
+	}
+	if buildRunInfo.BinaryOutput.Name == "" || buildRunInfo.BinaryOutput.Tag == "" {
+		return fmt.Errorf("build run [%s] did not produce an image", buildRunInfo.Id)
+	}
+
+	t.deployRun = deployRunInfo
+	t.buildRun = buildRunInfo
+	return nil
+}
+
+func (t *deployTask) Run(ctx context.Context, opts TaskOptions) error {
+	return runDeploy(ctx, t.deployRun, t.buildRun, opts.UserRepoLoc, opts.logOutput(), t.callbackPayload)
+}
+
+func (t *deployTask) Report(ctx context.Context, runErr error) error {
+	if runErr != nil {
+		t.callbackPayload.Error = runErr.Error()
+	}
+	if reason := cancelReason(ctx); reason != "" && t.callbackPayload.Status != Completed {
+		t.callbackPayload.Status = Canceled
+		t.callbackPayload.Error = fmt.Sprintf("canceled : %s", reason)
+	}
+	t.callbackPayload.IdempotencyKey = newIdempotencyKey()
+	return deliverTerminalCallback("deploy", t.deployRunId, t.callbackPayload.IdempotencyKey, t.callbackPayload, func() error {
+		return GetArgoClient().DeployRunCallback(t.deployRunId, t.callbackPayload)
+	})
+}
+
+func runDeploy(context context.Context, deployRunInfo *DeployRun, buildRunInfo *BuildRun, userRepoLoc string, logOutput io.Writer, callbackPayload *DeployRunCallbackPayload) error {
+
+	callbackPayload.Image = buildRunInfo.BinaryOutput.Name
+	callbackPayload.ImageTag = buildRunInfo.BinaryOutput.Tag
+	callbackPayload.Digest = buildRunInfo.BinaryOutput.Digest
+	ref := imageReference(callbackPayload.Image, callbackPayload.ImageTag, callbackPayload.Digest)
+
+	fmt.Printf("resolved image : [%s] \n", ref)
+
+	manifestDir := filepath.Join(userRepoLoc, deployRunInfo.ManifestPath)
+	if _, err := os.Stat(manifestDir); err != nil {
+		return err
+	}
+
+	client, err := dagger.Connect(context, dagger.WithLogOutput(logOutput))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	switch deployRunInfo.ManifestType {
+	case Helm:
+		err = renderHelmValues(manifestDir, deployRunInfo, callbackPayload.Image, pinnedTag(callbackPayload.ImageTag, callbackPayload.Digest))
+	case Kustomize:
+		err = renderKustomizeImage(context, client, manifestDir, deployRunInfo, callbackPayload.Image, ref)
+	default:
+		err = fmt.Errorf("unsupported manifest type : [%s]", deployRunInfo.ManifestType)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("manifests rendered : [%s] \n", manifestDir)
+
+	switch deployRunInfo.Strategy {
+	case Apply:
+		err = applyManifests(context, client, manifestDir, deployRunInfo)
+	case Commit:
+		callbackPayload.CommitSha, err = commitManifests(context, userRepoLoc, deployRunInfo, ref)
+	default:
+		err = fmt.Errorf("unsupported deploy strategy : [%s]", deployRunInfo.Strategy)
+	}
+	if err != nil {
+		return err
+	}
+
+	callbackPayload.Status = Completed
+
+	fmt.Printf("deploy process over: %s \n", ref)
+
+	return nil
+}
+
+func renderHelmValues(manifestDir string, deployRun *DeployRun, image string, tag string) error {
+	valuesFile := deployRun.ValuesFile
+	if valuesFile == "" {
+		valuesFile = defaultValuesFile
+	}
+	valuesPath := filepath.Join(manifestDir, valuesFile)
+
+	content, err := os.ReadFile(valuesPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	rendered, err := setHelmImageValues(content, image, tag)
+	if err != nil {
+		return fmt.Errorf("%s : %w", valuesFile, err)
+	}
+	return os.WriteFile(valuesPath, rendered, 0644)
+}
+
+// setHelmImageValues sets image.repository and image.tag of a helm values
+// document. Other values and comments are kept; an image value that is not a
+// mapping is replaced, and image.registry and image.digest are removed since
+// repository and tag name the full image.
+func setHelmImageValues(values []byte, image string, tag string) ([]byte, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(values, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse helm values : %w", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("helm values must be a mapping, found a %s", root.ShortTag())
+	}
+
+	imageNode := mappingValue(root, "image")
+	if imageNode == nil || imageNode.Kind != yaml.MappingNode {
+		replacement := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		if imageNode == nil {
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "image"}, replacement)
+		} else {
+			*imageNode = *replacement
+		}
+		imageNode = mappingValue(root, "image")
+	}
+
+	// the tag carries the digest, a digest value of the chart would win over it
+	removeMappingKey(imageNode, "registry")
+	removeMappingKey(imageNode, "digest")
+	setMappingValue(imageNode, "repository", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: image})
+	setMappingValue(imageNode, "tag", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tag, Style: yaml.DoubleQuotedStyle})
+
+	out := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// mappingValue returns the value node under key in mapping, nil if absent.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue replaces the value under key in mapping, keeping the
+// comments around it, or appends the key.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	if existing := mappingValue(mapping, key); existing != nil {
+		value.LineComment = existing.LineComment
+		value.HeadComment = existing.HeadComment
+		value.FootComment = existing.FootComment
+		*existing = *value
+		return
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// removeMappingKey removes key from mapping, a comment above it moves to the
+// next key.
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			if comment := mapping.Content[i].HeadComment; comment != "" && i+2 < len(mapping.Content) {
+				next := mapping.Content[i+2]
+				next.HeadComment = strings.TrimSpace(comment + "\n" + next.HeadComment)
+			}
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// imageReference is image@digest when the build reported a digest, so the
+// deploy cannot pick up a tag that was pushed again since, and image:tag
+// otherwise.
+func imageReference(image string, tag string, digest string) string {
+	if digest != "" {
+		return image + "@" + digest
+	}
+	return image + ":" + tag
+}
+
+// pinnedTag is the helm image.tag value, tag@digest renders as
+// repository:tag@digest, which pulls by digest.
+func pinnedTag(tag string, digest string) string {
+	if digest != "" {
+		return tag + "@" + digest
+	}
+	return tag
+}
+
+func renderKustomizeImage(ctx context.Context, client *dagger.Client, manifestDir string, deployRun *DeployRun, image string, ref string) error {
+	name := deployRun.ImageName
+	if name == "" {
+		name = image
+	}
+
+	rendered := client.Container().From(KUSTOMIZE_IMAGE).
+		WithMountedDirectory(manifestMountDir, client.Host().Directory(manifestDir)).
+		WithWorkdir(manifestMountDir).
+		WithEntrypoint([]string{}).
+		WithExec([]string{"/app/kustomize", "edit", "set", "image", fmt.Sprintf("%s=%s", name, ref)}).
+		Directory(manifestMountDir)
+
+	_, err := rendered.Export(ctx, manifestDir)
+	return err
+}
+
+func applyManifests(ctx context.Context, client *dagger.Client, manifestDir string, deployRun *DeployRun) error {
+	if deployRun.ClusterId == "" {
+		return errors.New("cluster identifier is missing for apply strategy")
+	}
+
+	clusterAccess, err := GetArgoClient().FetchClusterAccess(deployRun.ClusterId)
+	if err != nil {
+		return err
+	}
+
+	kubeconfig := client.SetSecret("kubeconfig", clusterAccess.Kubeconfig)
+
+	namespace := deployRun.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	var toolImage string
+	var cmd []string
+	switch deployRun.ManifestType {
+	case Helm:
+		valuesFile := deployRun.ValuesFile
+		if valuesFile == "" {
+			valuesFile = defaultValuesFile
+		}
+		releaseName := deployRun.ReleaseName
+		if releaseName == "" {
+			releaseName = filepath.Base(manifestDir)
+		}
+		toolImage = HELM_IMAGE
+		cmd = []string{"helm", "upgrade", "--install", releaseName, manifestMountDir,
+			"--namespace", namespace, "--create-namespace",
+			"--values", filepath.Join(manifestMountDir, valuesFile), "--wait"}
+	case Kustomize:
+		toolImage = KUBECTL_IMAGE
+		cmd = []string{"kubectl", "apply", "--namespace", namespace, "-k", manifestMountDir}
+	}
+
+	// the tool images do not all run as root, the kubeconfig must be readable
+	// by the image user
+	tool := client.Container().From(toolImage)
+	user, err := tool.User(ctx)
+	if err != nil {
+		return err
+	}
+	secretOpts := dagger.ContainerWithMountedSecretOpts{}
+	if user != "" {
+		secretOpts.Owner = user
+	}
+
+	out, err := tool.
+		WithMountedSecret(kubeconfigPath, kubeconfig, secretOpts).
+		WithEnvVariable("KUBECONFIG", kubeconfigPath).
+		WithMountedDirectory(manifestMountDir, client.Host().Directory(manifestDir)).
+		WithEntrypoint([]string{}).
+		WithExec(cmd).
+		Stdout(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("apply complete : [%s] \n", out)
+	return nil
+}
+
+func commitManifests(ctx context.Context, userRepoLoc string, deployRun *DeployRun, ref string) (string, error) {
+	git := func(command string, args ...string) (string, error) {
+		args = append([]string{"-C", userRepoLoc, "-c", "user.name=argonaut", "-c", "user.email=ci@argonaut.dev", command}, args...)
+		out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput()
+		if err != nil {
+			fmt.Printf("git %s failed : [%s] \n", command, string(out))
+			return "", fmt.Errorf("git %s failed : %s", command, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if _, err := git("add", "--", deployRun.ManifestPath); err != nil {
+		return "", err
+	}
+	staged, err := git("diff", "--cached", "--name-only", "--", deployRun.ManifestPath)
+	if err != nil {
+		return "", err
+	}
+	if staged == "" {
+		// a redeploy of the same image renders the same manifests
+		fmt.Printf("manifests already up to date : [%s] \n", deployRun.ManifestPath)
+		return git("rev-parse", "HEAD")
+	}
+	if _, err := git("commit", "-m", fmt.Sprintf("argonaut: deploy %s", ref)); err != nil {
+		return "", err
+	}
+
+	pushRef := "HEAD"
+	if deployRun.Branch != "" {
+		pushRef = "HEAD:" + deployRun.Branch
+	}
+	if _, err := git("push", "origin", pushRef); err != nil {
+		return "", err
+	}
+
+	return git("rev-parse", "HEAD")
+}
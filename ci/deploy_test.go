@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSetHelmImageValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  string
+		want    map[string]interface{}
+		keep    []string
+		wantErr bool
+	}{
+		{
+			name:   "block mapping",
+			values: "replicas: 2\nimage:\n  repository: nginx\n  tag: \"1\"\n  pullPolicy: IfNotPresent\n",
+			want: map[string]interface{}{
+				"replicas": 2,
+				"image":    map[string]interface{}{"repository": "reg/app", "tag": "20240101", "pullPolicy": "IfNotPresent"},
+			},
+		},
+		{
+			name:   "flow mapping",
+			values: "image: {repository: nginx, tag: \"1\"}\n",
+			want: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+		},
+		{
+			name:   "empty image with a comment",
+			values: "image: # set by argonaut\nservice:\n  port: 80\n",
+			want: map[string]interface{}{
+				"image":   map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+				"service": map[string]interface{}{"port": 80},
+			},
+		},
+		{
+			name:   "registry is dropped",
+			values: "image:\n  # pulled from docker hub\n  registry: docker.io\n  repository: nginx\n",
+			want: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+			keep: []string{"# pulled from docker hub"},
+		},
+		{
+			name:   "stale digest is dropped",
+			values: "image:\n  repository: nginx\n  digest: sha256:0000\n",
+			want: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+		},
+		{
+			name:   "image as a string",
+			values: "image: nginx:1\n",
+			want: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+		},
+		{
+			name:   "missing image",
+			values: "# values for my-app\nreplicas: 1\n",
+			want: map[string]interface{}{
+				"replicas": 1,
+				"image":    map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+			keep: []string{"# values for my-app"},
+		},
+		{
+			name:   "empty file",
+			values: "",
+			want: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+		},
+		{
+			name:   "comments kept",
+			values: "image:\n  # the app image\n  repository: nginx # upstream\n  tag: latest\n",
+			want: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "reg/app", "tag": "20240101"},
+			},
+			keep: []string{"# the app image", "# upstream"},
+		},
+		{
+			name:    "not a mapping",
+			values:  "- image\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid yaml",
+			values:  "image: [nginx\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := setHelmImageValues([]byte(tt.values), "reg/app", "20240101")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setHelmImageValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// yaml.v3 rejects duplicate keys, so this also catches a second image key
+			got := map[string]interface{}{}
+			if err := yaml.Unmarshal(out, &got); err != nil {
+				t.Fatalf("output is not valid yaml : %v\n%s", err, out)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setHelmImageValues() = %v, want %v\n%s", got, tt.want, out)
+			}
+			for _, comment := range tt.keep {
+				if !strings.Contains(string(out), comment) {
+					t.Errorf("setHelmImageValues() dropped %q\n%s", comment, out)
+				}
+			}
+		})
+	}
+}
+
+func TestImageReference(t *testing.T) {
+	tests := []struct {
+		image, tag, digest string
+		wantRef, wantTag   string
+	}{
+		{"reg/app", "1.0", "", "reg/app:1.0", "1.0"},
+		{"reg/app", "1.0", "sha256:abcd", "reg/app@sha256:abcd", "1.0@sha256:abcd"},
+		{"reg:5000/app", "main-1a2b3c4", "sha256:abcd", "reg:5000/app@sha256:abcd", "main-1a2b3c4@sha256:abcd"},
+	}
+	for _, tt := range tests {
+		if got := imageReference(tt.image, tt.tag, tt.digest); got != tt.wantRef {
+			t.Errorf("imageReference(%q, %q, %q) = %q, want %q", tt.image, tt.tag, tt.digest, got, tt.wantRef)
+		}
+		if got := pinnedTag(tt.tag, tt.digest); got != tt.wantTag {
+			t.Errorf("pinnedTag(%q, %q) = %q, want %q", tt.tag, tt.digest, got, tt.wantTag)
+		}
+	}
+}
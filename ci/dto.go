@@ -27,7 +27,7 @@ type BuildConfig struct {
 	OrganizationId  string             `json:"organization_id"`
 	CIIntegrationId string             `json:"ci_integration_id"`
 	RepoId          string             `json:"repo_id"`
-	BuildType       BuildType          `json:"build_type" validate:"required" enums:"docker"`
+	BuildType       BuildType          `json:"build_type" enums:"docker,buildpack"`
 	Details         BuildConfigDetails `json:"details"`
 	ArtifactoryType ArtifactoryType    `json:"artifactory_type" validate:"required" enums:"cr"`
 	ArtifactoryId   string             `json:"artifactory_id"`
@@ -38,8 +38,61 @@ type BuildConfigDetails struct {
 }
 
 type OCIBuildDetails struct {
-	DockerFilePath string `json:"docker_file_path" validate:"required"`
+	DockerFilePath string `json:"docker_file_path" validate:"required_unless=build_type buildpack"`
 	WorkingDir     string `json:"working_dir"`
+	Builder        string `json:"builder"`
+	RunImage       string `json:"run_image"`
+	// Tags are image tag templates such as {{branch}}-{{sha7}}-{{timestamp}}.
+	Tags []string `json:"tags"`
+	// DefaultBranch is the branch that also gets the latest tag, main by default.
+	DefaultBranch string `json:"default_branch"`
+	// Platforms to build, e.g. linux/amd64. Empty builds for the engine's platform.
+	Platforms []string `json:"platforms"`
+	// SecretModes picks how each build secret, by key, reaches the build.
+	SecretModes map[string]SecretMode `json:"secret_modes"`
+	Cache       CacheConfig           `json:"cache"`
+	// Labels are extra image labels, next to the OCI and argonaut ones.
+	Labels     map[string]string `json:"labels"`
+	Signing    SigningConfig     `json:"signing"`
+	SBOM       SBOMConfig        `json:"sbom"`
+	Provenance ProvenanceConfig  `json:"provenance"`
+	Scan       ScanConfig        `json:"scan"`
+}
+
+type SBOMConfig struct {
+	Disable bool `json:"disable"`
+	// Required fails the build when the sbom cannot be generated or pushed.
+	Required bool `json:"required"`
+}
+
+type ProvenanceConfig struct {
+	// Required fails the build when the provenance cannot be pushed.
+	Required bool `json:"required"`
+}
+
+type ScanConfig struct {
+	Enabled bool `json:"enabled"`
+	// FailOn is the lowest severity that fails the build, high by default.
+	FailOn        string `json:"fail_on" enums:"negligible,low,medium,high,critical"`
+	IgnoreUnfixed bool   `json:"ignore_unfixed"`
+}
+
+type SigningConfig struct {
+	// KeySecret names the build secret holding the PEM private key.
+	KeySecret string `json:"key_secret"`
+	// KeyFile is a PEM private key on disk, for local builds.
+	KeyFile string `json:"key_file"`
+	// Required fails the build when the image cannot be signed.
+	Required bool `json:"required"`
+}
+
+type CacheConfig struct {
+	Disable bool `json:"disable"`
+	// Paths inside the build container kept in cache volumes between runs.
+	Paths []string `json:"paths"`
+	// DefaultBranch seeds the cache of branches that have none yet, the build
+	// config's default branch when empty.
+	DefaultBranch string `json:"default_branch"`
 }
 
 type BuildRun struct {
@@ -61,6 +114,8 @@ type BuildRun struct {
 type BinaryOutput struct {
 	Name string `json:"name"`
 	Tag  string `json:"tag"`
+	// Digest is the manifest digest the build published, deploys pin it when set.
+	Digest string `json:"digest"`
 }
 
 type RepoMeta struct {
@@ -71,10 +126,131 @@ type RepoMeta struct {
 }
 
 type BuildRunCallbackPayload struct {
-	Image    string         `json:"image"`
-	ImageTag string         `json:"image_tag"`
-	Status   BuildRunStatus `json:"status"`
-	Error    string         `json:"error"`
+	Image     string         `json:"image"`
+	ImageTag  string         `json:"image_tag"`
+	ImageTags []string       `json:"image_tags,omitempty"`
+	BuildType BuildType      `json:"build_type"`
+	Status    BuildRunStatus `json:"status"`
+	Error     string         `json:"error"`
+	// Warnings are failed steps that did not fail the build, e.g. an sbom push
+	// after the image was published.
+	Warnings []string `json:"warnings,omitempty"`
+	// LogChunksDropped counts build log chunks that never reached midgard, the
+	// log shown in argonaut has gaps when it is not zero.
+	LogChunksDropped int `json:"log_chunks_dropped,omitempty"`
+	// IdempotencyKey lets the backend de-duplicate replayed terminal callbacks.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	Digest               string            `json:"digest,omitempty"`
+	ImageRef             string            `json:"image_ref,omitempty"`
+	ImageSize            int64             `json:"image_size,omitempty"`
+	LayerCount           int               `json:"layer_count,omitempty"`
+	Platforms            []string          `json:"platforms,omitempty"`
+	PlatformDigests      map[string]string `json:"platform_digests,omitempty"`
+	BuildDurationSeconds float64           `json:"build_duration_seconds,omitempty"`
+	StepTimings          []StepTiming      `json:"step_timings,omitempty"`
+	Checkout             *RepoCheckout     `json:"checkout,omitempty"`
+	ProvenanceRef        string            `json:"provenance_ref,omitempty"`
+	SignatureRef         string            `json:"signature_ref,omitempty"`
+	SBOM                 *SBOMSummary      `json:"sbom,omitempty"`
+	Scan                 *ScanReport       `json:"scan,omitempty"`
+}
+
+// SBOMSummary describes the SBOM attached to the image.
+type SBOMSummary struct {
+	Format       string         `json:"format"`
+	PackageCount int            `json:"package_count"`
+	Ecosystems   map[string]int `json:"ecosystems"`
+	Refs         []string       `json:"refs,omitempty"`
+}
+
+// ScanReport is the result of the vulnerability scan gate.
+type ScanReport struct {
+	Database      string         `json:"database"`
+	Threshold     string         `json:"threshold"`
+	Passed        bool           `json:"passed"`
+	BlockingCount int            `json:"blocking_count"`
+	Counts        map[string]int `json:"counts"`
+	Findings      []ScanFinding  `json:"findings"`
+	Truncated     bool           `json:"truncated,omitempty"`
+}
+
+type ScanFinding struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Type     string `json:"type"`
+	FixedIn  string `json:"fixed_in,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Blocking bool   `json:"blocking"`
+}
+
+// RepoCheckout describes the git checkout an image was built from.
+type RepoCheckout struct {
+	CommitSha   string            `json:"commit_sha"`
+	Branch      string            `json:"branch,omitempty"`
+	Tag         string            `json:"tag,omitempty"`
+	Remote      string            `json:"remote,omitempty"`
+	Message     string            `json:"message"`
+	Author      string            `json:"author"`
+	CommittedAt time.Time         `json:"committed_at"`
+	Dirty       bool              `json:"dirty"`
+	Submodules  map[string]string `json:"submodules,omitempty"`
+}
+
+type StepTiming struct {
+	Step            string  `json:"step"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// *************** Deploy **********************
+
+type DeployRun struct {
+	Id             string         `json:"id"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	BuildRunId     string         `json:"build_run_id" validate:"required"`
+	Status         BuildRunStatus `json:"status" validate:"required" enums:"requested,triggered,running,canceled,failed,completed"`
+	ManifestType   ManifestType   `json:"manifest_type" validate:"required" enums:"helm,kustomize"`
+	ManifestPath   string         `json:"manifest_path" validate:"required"`
+	ValuesFile     string         `json:"values_file"`
+	Strategy       DeployStrategy `json:"strategy" validate:"required" enums:"apply,commit"`
+	ReleaseName    string         `json:"release_name"`
+	Namespace      string         `json:"namespace"`
+	ImageName      string         `json:"image_name"`
+	ClusterId      string         `json:"cluster_id"`
+	Branch         string         `json:"branch"`
+	TriggeredBy    string         `json:"triggered_by"`
+	OrganizationId string         `json:"organization_id"`
+	PipelineRunId  string         `json:"pipeline_run_id"`
+}
+
+type ClusterAccess struct {
+	Kubeconfig string     `json:"kubeconfig"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type DeployRunCallbackPayload struct {
+	Image     string         `json:"image"`
+	ImageTag  string         `json:"image_tag"`
+	Digest    string         `json:"digest,omitempty"`
+	CommitSha string         `json:"commit_sha"`
+	Status    BuildRunStatus `json:"status"`
+	Error     string         `json:"error"`
+	// IdempotencyKey lets the backend de-duplicate replayed terminal callbacks.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+type BuildRunHeartbeatPayload struct {
+	Status         BuildRunStatus `json:"status"`
+	Step           string         `json:"step"`
+	ElapsedSeconds int64          `json:"elapsed_seconds"`
+}
+
+type BuildLogChunk struct {
+	Sequence int64  `json:"sequence"`
+	Content  string `json:"content"`
 }
 
 // ************* Container Registry ************
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DAGGER_ENGINE_IMAGE must match the engine version of the dagger SDK in go.mod.
+	DAGGER_ENGINE_IMAGE = "registry.dagger.io/engine:v0.8.8"
+
+	engineContainerName = "argonaut-dagger-engine"
+	engineStateVolume   = "argonaut-dagger-engine"
+	engineStateDir      = "/var/lib/dagger"
+	// engineStateFile carries the argonaut- prefix so pruneCaches treats it like
+	// the volume tarballs.
+	engineStateFile     = "argonaut-engine-state.tar"
+	engineRunnerHostEnv = "_EXPERIMENTAL_DAGGER_RUNNER_HOST"
+	engineSaveTimeout   = 10 * time.Minute
+)
+
+// startCachedEngine runs the dagger engine in a container of its own whose
+// state, and with it the BuildKit layer cache of Dockerfile builds, is restored
+// from and saved to a tarball in dir. The Dockerfile frontend takes no cache
+// volumes and cannot export its cache, so the engine state is what carries
+// layers from one run to the next. The returned function stops the engine and
+// saves its state; call it after the dagger client is closed.
+func startCachedEngine(ctx context.Context, dir string) (func(), error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, fmt.Errorf("docker is needed to cache the engine state : %w", err)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// a leftover engine of an earlier run on the same host holds the volume
+	docker(ctx, "rm", "-f", engineContainerName)
+	if _, err := docker(ctx, "volume", "create", engineStateVolume); err != nil {
+		return nil, err
+	}
+
+	// a persistent runner keeps the volume, a fresh one starts from the tarball
+	script := fmt.Sprintf(`set -e
+if [ -n "$(ls -A %[1]s)" ]; then state=hit
+elif [ -f /cache/%[2]s ]; then tar -xf /cache/%[2]s -C %[1]s; state=restored
+else state=miss; fi
+echo "$state $(du -sk %[1]s | cut -f1)"`, engineStateDir, engineStateFile)
+	out, err := docker(ctx, "run", "--rm",
+		"-v", engineStateVolume+":"+engineStateDir,
+		"-v", dir+":/cache",
+		CACHE_HELPER_IMAGE, "sh", "-c", script)
+	if err != nil {
+		return nil, fmt.Errorf("engine cache restore : %w", err)
+	}
+	state, size, _ := parseCacheStats(out + " -")
+	fmt.Printf("engine cache : %s, %s KiB \n", state, size)
+	if state == "restored" {
+		// a used tarball counts as fresh for pruneCaches
+		now := time.Now()
+		if err := os.Chtimes(filepath.Join(dir, engineStateFile), now, now); err != nil {
+			fmt.Printf("engine cache : [%v] \n", err)
+		}
+	}
+
+	if _, err := docker(ctx, "run", "-d", "--name", engineContainerName, "--privileged",
+		"-v", engineStateVolume+":"+engineStateDir, DAGGER_ENGINE_IMAGE); err != nil {
+		return nil, fmt.Errorf("engine start : %w", err)
+	}
+	previous, hadPrevious := os.LookupEnv(engineRunnerHostEnv)
+	os.Setenv(engineRunnerHostEnv, "docker-container://"+engineContainerName)
+
+	return func() {
+		if hadPrevious {
+			os.Setenv(engineRunnerHostEnv, previous)
+		} else {
+			os.Unsetenv(engineRunnerHostEnv)
+		}
+		// the build context may already be canceled, saving is still worth it
+		saveCtx, cancel := context.WithTimeout(context.Background(), engineSaveTimeout)
+		defer cancel()
+		if err := saveEngineState(saveCtx, dir); err != nil {
+			fmt.Printf("engine cache save failed : [%v] \n", err)
+		}
+	}, nil
+}
+
+// saveEngineState stops the engine, so BuildKit flushes its metadata, and
+// writes its state volume to the tarball in dir.
+func saveEngineState(ctx context.Context, dir string) error {
+	if _, err := docker(ctx, "stop", engineContainerName); err != nil {
+		return err
+	}
+	if _, err := docker(ctx, "rm", engineContainerName); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`set -e
+tar -cf /cache/%[2]s.tmp -C %[1]s .
+mv /cache/%[2]s.tmp /cache/%[2]s
+echo "saved $(du -sk /cache/%[2]s | cut -f1)"`, engineStateDir, engineStateFile)
+	out, err := docker(ctx, "run", "--rm",
+		"-v", engineStateVolume+":"+engineStateDir,
+		"-v", dir+":/cache",
+		CACHE_HELPER_IMAGE, "sh", "-c", script)
+	if err != nil {
+		return err
+	}
+	_, size, _ := parseCacheStats(out + " -")
+	fmt.Printf("engine cache saved to [%s] : %s KiB \n", filepath.Join(dir, engineStateFile), size)
+	return nil
+}
+
+func docker(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker %s : %w : %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
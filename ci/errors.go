@@ -1,7 +1,144 @@
 package main
 
-import "errors"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
 
 var (
 	ErrCodeInResponse = errors.New("error code in response")
 )
+
+const apiErrorMessageLimit = 300
+
+// APIError is an error status returned by the argonaut backend. It matches
+// ErrCodeInResponse with errors.Is.
+type APIError struct {
+	StatusCode int
+	Method     string
+	Endpoint   string
+	RequestID  string
+	// Message is the error reported by the server, or the start of the body
+	// when it is not a json error.
+	Message string
+}
+
+func newAPIError(resp *resty.Response) *APIError {
+	e := &APIError{
+		StatusCode: resp.StatusCode(),
+		RequestID:  resp.Header().Get("X-Request-Id"),
+		Message:    serverMessage(resp.Body()),
+	}
+	if req := resp.Request; req != nil {
+		e.Method = req.Method
+		e.Endpoint = req.URL
+		if req.RawRequest != nil {
+			e.Endpoint = req.RawRequest.URL.Path
+		}
+	}
+	if e.RequestID == "" {
+		e.RequestID = resp.Header().Get("X-Correlation-Id")
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("argonaut api %s %s returned %d %s", e.Method, e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += " : " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request id [%s])", e.RequestID)
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == ErrCodeInResponse
+}
+
+// IsRetryable reports whether the request may succeed when sent again.
+func (e *APIError) IsRetryable() bool {
+	return e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// IsAuth reports whether the credentials were rejected or lack access.
+func (e *APIError) IsAuth() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+func (e *APIError) IsNotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// serverMessage extracts the error message of a json error body such as
+// {"message": "..."} or {"errors": [{"message": "..."}]}.
+func serverMessage(body []byte) string {
+	parsed := struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+		Detail  string `json:"detail"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if json.Unmarshal(body, &parsed) == nil {
+		messages := []string{}
+		for _, candidate := range []string{parsed.Message, parsed.Error, parsed.Detail} {
+			if candidate != "" {
+				messages = append(messages, candidate)
+			}
+		}
+		for _, e := range parsed.Errors {
+			if e.Message != "" {
+				messages = append(messages, e.Message)
+			}
+		}
+		if len(messages) > 0 {
+			return strings.Join(messages, "; ")
+		}
+	}
+
+	text := strings.TrimSpace(string(body))
+	if len(text) > apiErrorMessageLimit {
+		text = text[:apiErrorMessageLimit] + "..."
+	}
+	return text
+}
+
+// isRetryableError reports whether err is worth another attempt: a backend
+// error status that may pass later or a failure to reach the backend at all.
+// Anything else, such as an undecodable or invalid response, fails the same
+// way when sent again.
+func isRetryableError(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.IsRetryable()
+	}
+	// net/http reports transport failures as *url.Error, except for a request
+	// url that does not parse
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Op != "parse"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func isAuthError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.IsAuth()
+}
+
+func isNotFoundError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.IsNotFound()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestServerMessage(t *testing.T) {
+	long := strings.Repeat("x", apiErrorMessageLimit+50)
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "message", body: `{"message": "build run not found"}`, want: "build run not found"},
+		{name: "error", body: `{"error": "invalid token"}`, want: "invalid token"},
+		{name: "detail", body: `{"detail": "rate limited"}`, want: "rate limited"},
+		{name: "errors list", body: `{"errors": [{"message": "bad sha"}, {"message": ""}, {"message": "bad branch"}]}`, want: "bad sha; bad branch"},
+		{name: "all fields", body: `{"message": "invalid request", "error": "bad_request", "errors": [{"message": "bad sha"}]}`, want: "invalid request; bad_request; bad sha"},
+		{name: "json without a message", body: `{"status": "failed"}`, want: `{"status": "failed"}`},
+		{name: "plain text", body: "  upstream connect error \n", want: "upstream connect error"},
+		{name: "long html is cut", body: long, want: long[:apiErrorMessageLimit] + "..."},
+		{name: "at the limit", body: long[:apiErrorMessageLimit], want: long[:apiErrorMessageLimit]},
+		{name: "empty", body: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serverMessage([]byte(tt.body)); got != tt.want {
+				t.Errorf("serverMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		header    http.Header
+		body      string
+		wantID    string
+		wantError string
+	}{
+		{
+			name:      "request id",
+			status:    404,
+			header:    http.Header{"X-Request-Id": []string{"req-1"}, "X-Correlation-Id": []string{"corr-1"}},
+			body:      `{"message": "build run not found"}`,
+			wantID:    "req-1",
+			wantError: "argonaut api GET /api/v1/build/run/1 returned 404 Not Found : build run not found (request id [req-1])",
+		},
+		{
+			name:      "correlation id fallback",
+			status:    503,
+			header:    http.Header{"X-Correlation-Id": []string{"corr-1"}},
+			body:      "<html>unavailable</html>",
+			wantID:    "corr-1",
+			wantError: "argonaut api GET /api/v1/build/run/1 returned 503 Service Unavailable : <html>unavailable</html> (request id [corr-1])",
+		},
+		{
+			name:      "no id or body",
+			status:    401,
+			wantError: "argonaut api GET /api/v1/build/run/1 returned 401 Unauthorized",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for key, values := range tt.header {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			resp, err := resty.New().R().Get(server.URL + "/api/v1/build/run/1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			apiErr := newAPIError(resp)
+			if apiErr.StatusCode != tt.status || apiErr.Method != http.MethodGet || apiErr.Endpoint != "/api/v1/build/run/1" {
+				t.Errorf("newAPIError() = %d %s %s, want %d GET /api/v1/build/run/1", apiErr.StatusCode, apiErr.Method, apiErr.Endpoint, tt.status)
+			}
+			if apiErr.RequestID != tt.wantID {
+				t.Errorf("RequestID = %q, want %q", apiErr.RequestID, tt.wantID)
+			}
+			if apiErr.Error() != tt.wantError {
+				t.Errorf("Error() = %q, want %q", apiErr.Error(), tt.wantError)
+			}
+			if !errors.Is(apiErr, ErrCodeInResponse) {
+				t.Errorf("newAPIError() does not match ErrCodeInResponse")
+			}
+		})
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	_, parseErr := url.Parse(":/bad")
+	var syntaxErr *json.SyntaxError
+	decodeErr := json.Unmarshal([]byte("<html>"), &map[string]interface{}{})
+	if !errors.As(decodeErr, &syntaxErr) {
+		t.Fatalf("json.Unmarshal() error = %v, want a syntax error", decodeErr)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "server error", err: &APIError{StatusCode: 502}, want: true},
+		{name: "too many requests", err: &APIError{StatusCode: 429}, want: true},
+		{name: "request timeout", err: &APIError{StatusCode: 408}, want: true},
+		{name: "wrapped server error", err: fmt.Errorf("upload : %w", &APIError{StatusCode: 500}), want: true},
+		{name: "client error", err: &APIError{StatusCode: 422}, want: false},
+		{name: "auth error", err: &APIError{StatusCode: 401}, want: false},
+		{name: "connection refused", err: &url.Error{Op: "Post", URL: "https://api", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, want: true},
+		{name: "timeout", err: &url.Error{Op: "Post", URL: "https://api", Err: context.DeadlineExceeded}, want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "dns failure", err: &net.DNSError{Err: "no such host", Name: "api"}, want: true},
+		{name: "bad url", err: parseErr, want: false},
+		{name: "json decode", err: decodeErr, want: false},
+		{name: "invalid response", err: &ValidationError{Type: "BuildRun", Fields: []FieldError{{Field: "id", Problem: "is required"}}}, want: false},
+		{name: "other", err: errors.New("token refresh failed"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Errorf("isRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
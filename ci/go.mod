@@ -1,23 +1,24 @@
 module github.com/argonautdev/argonaut-action
 
-go 1.18
+go 1.20
 
-require dagger.io/dagger v0.4.5
+require (
+	dagger.io/dagger v0.8.8
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	go.uber.org/atomic v1.7.0 // indirect
-	go.uber.org/multierr v1.6.0 // indirect
-	golang.org/x/net v0.0.0-20211029224645-99673261e6eb // indirect
+	github.com/99designs/gqlgen v0.17.31 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
+	golang.org/x/net v0.15.0 // indirect
 )
 
 require (
-	github.com/Khan/genqlient v0.5.0 // indirect
+	github.com/Khan/genqlient v0.6.0 // indirect
 	github.com/adrg/xdg v0.4.0 // indirect
 	github.com/go-resty/resty/v2 v2.7.0
-	github.com/iancoleman/strcase v0.2.0 // indirect
 	github.com/tidwall/pretty v1.2.1
-	github.com/vektah/gqlparser/v2 v2.5.1 // indirect
-	go.uber.org/zap v1.24.0
-	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
-	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
+	github.com/vektah/gqlparser/v2 v2.5.6 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
 )
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+type imageDetails struct {
+	Digest     string
+	Size       int64
+	LayerCount int
+	Platforms  []string
+	// PlatformDigests maps each platform of a manifest list to its manifest digest.
+	PlatformDigests map[string]string
+}
+
+// describePublishedImage reads the pushed manifest back from the registry to
+// learn the size, layer count and platforms of the image at digest.
+func describePublishedImage(access *RegistryAccess, image string, digest string) (*imageDetails, error) {
+	if digest == "" {
+		return nil, errors.New("publish did not return a digest")
+	}
+
+	registry := newRegistryClient(access)
+	manifest, _, err := registry.GetManifest(image, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &imageDetails{Digest: digest}
+	manifests := []*Manifest{manifest}
+
+	if manifest.IsIndex() {
+		manifests = nil
+		details.PlatformDigests = map[string]string{}
+		for _, child := range manifest.Manifests {
+			if child.Platform == nil || child.Platform.OS == "unknown" {
+				// attestation manifests are not runnable images
+				continue
+			}
+			childManifest, _, err := registry.GetManifest(image, child.Digest)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, childManifest)
+			details.Platforms = append(details.Platforms, child.Platform.String())
+			details.PlatformDigests[child.Platform.String()] = child.Digest
+		}
+	}
+
+	blobs := map[string]int64{}
+	for _, m := range manifests {
+		if m.Config != nil {
+			blobs[m.Config.Digest] = m.Config.Size
+		}
+		for _, layer := range m.Layers {
+			if _, seen := blobs[layer.Digest]; !seen {
+				details.LayerCount++
+			}
+			blobs[layer.Digest] = layer.Size
+		}
+	}
+	for _, size := range blobs {
+		details.Size += size
+	}
+	sort.Strings(details.Platforms)
+
+	return details, nil
+}
+
+func (d *imageDetails) String() string {
+	return fmt.Sprintf("digest %s size %d layers %d platforms %v", d.Digest, d.Size, d.LayerCount, d.Platforms)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const argonautLabelPrefix = "dev.argonaut."
+
+// imageLabels returns the standard OCI labels and the argonaut provenance
+// labels for the image, merged with the extra labels of the build config.
+// Extra labels may override OCI labels but not argonaut ones. The created
+// label is the build time, as the OCI spec defines it; the commit time goes in
+// dev.argonaut.commit-time.
+func imageLabels(spec *buildSpec, checkout *RepoCheckout, vars map[string]string, tags []string, created time.Time) map[string]string {
+	commitTime := ""
+	if checkout != nil && !checkout.CommittedAt.IsZero() {
+		commitTime = checkout.CommittedAt.UTC().Format(time.RFC3339)
+	}
+	labels := map[string]string{
+		"org.opencontainers.image.title":   spec.BuildConfig.Name,
+		"org.opencontainers.image.created": created.UTC().Format(time.RFC3339),
+		"org.opencontainers.image.version": tags[0],
+	}
+	if vars["semver"] != "" {
+		labels["org.opencontainers.image.version"] = vars["semver"]
+	}
+	if checkout != nil {
+		labels["org.opencontainers.image.revision"] = checkout.CommitSha
+		if checkout.Remote != "" {
+			labels["org.opencontainers.image.source"] = checkout.Remote
+		}
+	}
+
+	for key, value := range spec.BuildConfig.Details.OCIBuildDetails.Labels {
+		if strings.HasPrefix(key, argonautLabelPrefix) {
+			fmt.Printf("label [%s] ignored : the %s namespace is reserved \n", key, argonautLabelPrefix)
+			continue
+		}
+		labels[key] = value
+	}
+
+	argonaut := map[string]string{
+		"build-config-id": spec.BuildConfig.Id,
+		"build-run-id":    spec.BuildRun.Id,
+		"commit-time":     commitTime,
+		"organization-id": spec.BuildConfig.OrganizationId,
+	}
+	for key, value := range argonaut {
+		if value != "" {
+			labels[argonautLabelPrefix+key] = value
+		}
+	}
+	return labels
+}
+
+// withLabels applies labels in sorted order, so the image config depends on
+// the labels only and not on map iteration order.
+func withLabels(container *dagger.Container, labels map[string]string) *dagger.Container {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		container = container.WithLabel(key, labels[key])
+	}
+	return container
+}
+
+// publicRemote strips credentials, as CI systems embed tokens in clone urls.
+func publicRemote(remote string) string {
+	parsed, err := url.Parse(remote)
+	if err != nil || parsed.Scheme == "" {
+		// scp-like remotes such as git@github.com:org/repo.git carry no secret
+		return remote
+	}
+	parsed.User = nil
+	return parsed.String()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LocalBuildDocument is the on-disk replacement for the backend calls made by
+// the build task. Every section uses the same json shape as the backend dto.
+type LocalBuildDocument struct {
+	BuildConfig    BuildConfig     `json:"build_config"`
+	BuildRun       BuildRun        `json:"build_run"`
+	RegistryAccess *RegistryAccess `json:"registry_access"`
+	Secrets        []BuildSecret   `json:"secrets"`
+}
+
+func loadLocalBuildDocument(path string) (*LocalBuildDocument, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := LocalBuildDocument{}
+	if err := unmarshalDocument(data, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse build config [%s] : %w", path, err)
+	}
+	if doc.BuildConfig.Name == "" {
+		return nil, errors.New("build_config.name is required")
+	}
+	if doc.BuildConfig.BuildType == "" {
+		doc.BuildConfig.BuildType = Docker
+	}
+	return &doc, nil
+}
+
+// runLocalBuild builds from a local document without talking to midgard. The
+// image is published only when the document carries registry access.
+func runLocalBuild(ctx context.Context, configPath string, opts TaskOptions) error {
+
+	fmt.Println("local build started")
+
+	doc, err := loadLocalBuildDocument(configPath)
+	if err != nil {
+		return err
+	}
+
+	if doc.RegistryAccess == nil && opts.ImageTarball == "" {
+		opts.ImageTarball = doc.BuildConfig.Name + ".tar"
+	}
+
+	spec := &buildSpec{
+		BuildRun:       &doc.BuildRun,
+		BuildConfig:    &doc.BuildConfig,
+		RegistryAccess: doc.RegistryAccess,
+		Secrets:        doc.Secrets,
+	}
+
+	result := &BuildRunCallbackPayload{
+		Status:    Failed,
+		BuildType: doc.BuildConfig.BuildType,
+	}
+
+	progress := newTaskProgress()
+	err = runBuild(ctx, spec, opts, progress, result)
+	result.recordTimings(progress)
+
+	fmt.Printf("local build result : image [%s] tag [%s] digest [%s] status [%s] duration [%.1fs] \n", result.Image, result.ImageTag, result.Digest, result.Status, result.BuildDurationSeconds)
+	for _, timing := range result.StepTimings {
+		fmt.Printf("  %-20s %.1fs \n", timing.Step, timing.DurationSeconds)
+	}
+	return err
+}
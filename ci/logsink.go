@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	logChunkSize      = 64 * 1024
+	logFlushInterval  = 2 * time.Second
+	logQueueSize      = 32
+	logSpillLimit     = 64 * 1024 * 1024
+	logUploadAttempts = 5
+	logUploadTimeout  = 10 * time.Second
+	logCloseTimeout   = 30 * time.Second
+)
+
+// logSink tees build output to midgard. Output is cut into ordered chunks that
+// a single goroutine uploads with retries. Write never waits on the backend:
+// chunks the upload has not caught up with are kept in memory, then spilled to
+// a temp file of up to logSpillLimit bytes. Only beyond that, or when an
+// upload keeps failing, is a chunk dropped and counted.
+type logSink struct {
+	upload     func(chunk *BuildLogChunk) error
+	spillLimit int64
+
+	mu       sync.Mutex
+	buf      []byte
+	sequence int64
+	closed   bool
+	dropped  int
+	pending  []*BuildLogChunk
+	spill    *logSpill
+
+	wake     chan struct{}
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// logSpill is the on-disk part of the upload queue, records are read back in
+// the order they were written.
+type logSpill struct {
+	file    *os.File
+	read    int64
+	written int64
+	sizes   []int
+}
+
+func newLogSink(upload func(chunk *BuildLogChunk) error) *logSink {
+	s := &logSink{
+		upload:     upload,
+		spillLimit: logSpillLimit,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	go s.uploadLoop()
+	go s.flushLoop()
+	return s
+}
+
+func newBuildLogSink(buildRunId string) *logSink {
+	return newLogSink(func(chunk *BuildLogChunk) error {
+		return GetArgoClient().UploadBuildLogs(buildRunId, chunk)
+	})
+}
+
+func (s *logSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return len(p), nil
+	}
+	s.buf = append(s.buf, p...)
+	for len(s.buf) >= logChunkSize {
+		// prefer cutting at a line end so lines are not split across chunks
+		cut := bytes.LastIndexByte(s.buf[:logChunkSize], '\n') + 1
+		if cut == 0 {
+			cut = logChunkSize
+		}
+		s.enqueueLocked(s.buf[:cut])
+		s.buf = s.buf[cut:]
+	}
+	return len(p), nil
+}
+
+// enqueueLocked must be called with mu held so sequence numbers follow the
+// order of the output. Once chunks are spilled, newer ones are spilled too
+// until the upload has read the spill back, which keeps them in order.
+func (s *logSink) enqueueLocked(content []byte) {
+	if len(content) == 0 {
+		return
+	}
+	s.sequence++
+	chunk := &BuildLogChunk{Sequence: s.sequence, Content: string(content)}
+
+	if len(s.pending) < logQueueSize && (s.spill == nil || s.spill.empty()) {
+		s.pending = append(s.pending, chunk)
+	} else if err := s.spillLocked(chunk); err != nil {
+		if s.dropped == 0 {
+			fmt.Printf("log upload is behind, dropping build log chunks : [%v] \n", err)
+		}
+		s.dropped++
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *logSink) spillLocked(chunk *BuildLogChunk) error {
+	record, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	if s.spill == nil {
+		file, err := os.CreateTemp("", "argonaut-logs-*.jsonl")
+		if err != nil {
+			return err
+		}
+		s.spill = &logSpill{file: file}
+		fmt.Printf("log upload is behind, buffering build logs in [%s] \n", file.Name())
+	}
+	if s.spill.written-s.spill.read+int64(len(record)) > s.spillLimit {
+		return fmt.Errorf("log buffer of %d bytes is full", s.spillLimit)
+	}
+	if _, err := s.spill.file.WriteAt(record, s.spill.written); err != nil {
+		return err
+	}
+	s.spill.written += int64(len(record))
+	s.spill.sizes = append(s.spill.sizes, len(record))
+	return nil
+}
+
+// nextLocked returns the oldest chunk not uploaded yet, nil when there is none.
+func (s *logSink) nextLocked() *BuildLogChunk {
+	if len(s.pending) > 0 {
+		chunk := s.pending[0]
+		s.pending = s.pending[1:]
+		return chunk
+	}
+	for s.spill != nil && !s.spill.empty() {
+		chunk, err := s.spill.next()
+		if err == nil {
+			return chunk
+		}
+		fmt.Printf("log buffer read failed, dropping a chunk : [%v] \n", err)
+		s.dropped++
+	}
+	return nil
+}
+
+func (l *logSpill) empty() bool {
+	return len(l.sizes) == 0
+}
+
+func (l *logSpill) next() (*BuildLogChunk, error) {
+	record := make([]byte, l.sizes[0])
+	_, err := l.file.ReadAt(record, l.read)
+	l.read += int64(l.sizes[0])
+	l.sizes = l.sizes[1:]
+	if l.empty() {
+		// start over so the file does not grow past what is unread
+		l.read, l.written = 0, 0
+		l.file.Truncate(0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	chunk := &BuildLogChunk{}
+	return chunk, json.Unmarshal(record, chunk)
+}
+
+func (s *logSink) flushLoop() {
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if !s.closed {
+				s.enqueueLocked(s.buf)
+				s.buf = nil
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *logSink) uploadLoop() {
+	defer close(s.finished)
+
+	for {
+		s.mu.Lock()
+		chunk := s.nextLocked()
+		closed := s.closed
+		s.mu.Unlock()
+
+		if chunk == nil {
+			if closed {
+				return
+			}
+			select {
+			case <-s.wake:
+			case <-s.done:
+			}
+			continue
+		}
+
+		var err error
+		for attempt := 0; attempt < logUploadAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<attempt) * 250 * time.Millisecond)
+			}
+			if err = s.upload(chunk); err == nil || !isRetryableError(err) {
+				break
+			}
+		}
+		if err != nil {
+			fmt.Printf("log upload failed, dropping chunk [%d] : [%v] \n", chunk.Sequence, err)
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Dropped is the number of chunks that never reached midgard.
+func (s *logSink) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close uploads whatever is buffered and waits for the queue to drain, giving
+// up after logCloseTimeout so a dead backend cannot hold the task hostage.
+// Chunks still queued then count as dropped.
+func (s *logSink) Close() error {
+	deadline := time.After(logCloseTimeout)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.enqueueLocked(s.buf)
+	s.buf = nil
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	var err error
+	select {
+	case <-s.finished:
+	case <-deadline:
+		err = fmt.Errorf("log upload did not finish within %s", logCloseTimeout)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the upload loop may still be running after a timeout, it then finds
+	// nothing left to send
+	s.dropped += len(s.pending)
+	s.pending = nil
+	if s.spill != nil {
+		s.dropped += len(s.spill.sizes)
+		s.spill.sizes = nil
+		s.spill.file.Close()
+		os.Remove(s.spill.file.Name())
+	}
+	if s.dropped > 0 {
+		fmt.Printf("log upload dropped %d chunks \n", s.dropped)
+	}
+	return err
+}
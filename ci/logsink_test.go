@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingUpload collects uploaded chunks and blocks until release is closed.
+type recordingUpload struct {
+	mu      sync.Mutex
+	release chan struct{}
+	chunks  []*BuildLogChunk
+}
+
+func (r *recordingUpload) upload(chunk *BuildLogChunk) error {
+	<-r.release
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = append(r.chunks, chunk)
+	return nil
+}
+
+func writeChunks(t *testing.T, sink *logSink, n int) {
+	line := strings.Repeat("x", logChunkSize-1) + "\n"
+	for i := 0; i < n; i++ {
+		done := make(chan struct{})
+		go func() {
+			sink.Write([]byte(line))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Write blocked on chunk %d while the upload is stalled", i)
+		}
+	}
+}
+
+func TestLogSinkSpillsInOrder(t *testing.T) {
+	upload := &recordingUpload{release: make(chan struct{})}
+	sink := newLogSink(upload.upload)
+
+	// far more chunks than the memory queue holds, while the upload hangs
+	total := logQueueSize * 3
+	writeChunks(t, sink, total)
+	close(upload.release)
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if sink.Dropped() != 0 {
+		t.Errorf("Dropped() = %d, want 0", sink.Dropped())
+	}
+	if len(upload.chunks) != total {
+		t.Fatalf("uploaded %d chunks, want %d", len(upload.chunks), total)
+	}
+	for i, chunk := range upload.chunks {
+		if chunk.Sequence != int64(i+1) {
+			t.Fatalf("chunk %d has sequence %d, want %d", i, chunk.Sequence, i+1)
+		}
+		if len(chunk.Content) != logChunkSize {
+			t.Fatalf("chunk %d has %d bytes, want %d", i, len(chunk.Content), logChunkSize)
+		}
+	}
+}
+
+func TestLogSinkDropsPastSpillLimit(t *testing.T) {
+	upload := &recordingUpload{release: make(chan struct{})}
+	sink := newLogSink(upload.upload)
+	sink.mu.Lock()
+	// room for two spilled chunks, json escaping adds a few bytes each
+	sink.spillLimit = 2*logChunkSize + 1024
+	sink.mu.Unlock()
+
+	// one chunk is taken by the stalled upload, the queue holds logQueueSize
+	total := 1 + logQueueSize + 2 + 5
+	writeChunks(t, sink, total)
+	close(upload.release)
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	uploaded := len(upload.chunks)
+	if uploaded+sink.Dropped() != total {
+		t.Errorf("uploaded %d and dropped %d, want %d in total", uploaded, sink.Dropped(), total)
+	}
+	if sink.Dropped() == 0 {
+		t.Errorf("Dropped() = 0, want the chunks past the spill limit")
+	}
+	for i := 1; i < uploaded; i++ {
+		if upload.chunks[i].Sequence <= upload.chunks[i-1].Sequence {
+			t.Fatalf("chunks out of order : %s", sequences(upload.chunks))
+		}
+	}
+}
+
+func sequences(chunks []*BuildLogChunk) string {
+	out := []string{}
+	for _, chunk := range chunks {
+		out = append(out, fmt.Sprint(chunk.Sequence))
+	}
+	return strings.Join(out, ",")
+}
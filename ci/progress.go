@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// periodicRequestTimeout bounds a heartbeat or cancel poll, the client has no
+// timeout of its own and stopping the loop waits for the request in flight.
+const periodicRequestTimeout = 10 * time.Second
+
+// taskProgress records which step a task is in and how long each step took.
+// It is read concurrently by the heartbeat goroutine.
+type taskProgress struct {
+	mu            sync.Mutex
+	startedAt     time.Time
+	step          string
+	stepStartedAt time.Time
+	timings       []StepTiming
+}
+
+func newTaskProgress() *taskProgress {
+	now := time.Now()
+	return &taskProgress{startedAt: now, step: "starting", stepStartedAt: now}
+}
+
+func (p *taskProgress) Step(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.timings = append(p.timings, newStepTiming(p.step, now.Sub(p.stepStartedAt)))
+	p.step = name
+	p.stepStartedAt = now
+	fmt.Printf("step : [%s] elapsed : [%s] \n", name, now.Sub(p.startedAt).Round(time.Second))
+}
+
+// Timings returns the finished steps plus the current one measured up to now.
+func (p *taskProgress) Timings() []StepTiming {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timings := append([]StepTiming{}, p.timings...)
+	return append(timings, newStepTiming(p.step, time.Since(p.stepStartedAt)))
+}
+
+func newStepTiming(step string, d time.Duration) StepTiming {
+	return StepTiming{Step: step, DurationSeconds: d.Round(time.Millisecond).Seconds()}
+}
+
+func (p *taskProgress) Snapshot() (string, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.step, time.Since(p.startedAt)
+}
+
+// startHeartbeat calls send every interval until the returned stop function
+// is called.
+func startHeartbeat(ctx context.Context, interval time.Duration, progress *taskProgress, send func(step string, elapsed time.Duration) error) func() {
+	return startPeriodic(ctx, interval, func() {
+		step, elapsed := progress.Snapshot()
+		if err := send(step, elapsed); err != nil {
+			fmt.Printf("heartbeat failed : [%v] \n", err)
+		}
+	})
+}
+
+// startPeriodic runs fn every interval until ctx is done or the returned stop
+// function is called. stop waits for an in-flight fn, so nothing runs after it
+// returns. A non-positive interval disables the loop.
+func startPeriodic(ctx context.Context, interval time.Duration, fn func()) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	InTotoStatementType  = "https://in-toto.io/Statement/v1"
+	SLSAProvenanceType   = "https://slsa.dev/provenance/v1"
+	MediaTypeInToto      = "application/vnd.in-toto+json"
+	ARGONAUT_BUILDER_ID  = "https://github.com/argonautdev/argonaut-action"
+	argonautBuildTypeFmt = "https://argonaut.dev/build/%s@v1"
+)
+
+type InTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []InTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     interface{}     `json:"predicate"`
+}
+
+type InTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type SLSAProvenance struct {
+	BuildDefinition SLSABuildDefinition `json:"buildDefinition"`
+	RunDetails      SLSARunDetails      `json:"runDetails"`
+}
+
+type SLSABuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters,omitempty"`
+	ResolvedDependencies []SLSAResource         `json:"resolvedDependencies,omitempty"`
+}
+
+type SLSAResource struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+type SLSARunDetails struct {
+	Builder  SLSABuilder  `json:"builder"`
+	Metadata SLSAMetadata `json:"metadata"`
+}
+
+type SLSABuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type SLSAMetadata struct {
+	InvocationID string    `json:"invocationId"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// provenanceStatement describes how the published image was built: the build
+// config and run that asked for it, the source commit and the builder.
+func provenanceStatement(spec *buildSpec, checkout *RepoCheckout, payload *BuildRunCallbackPayload, started time.Time, finished time.Time) *InTotoStatement {
+	subjects := []InTotoSubject{subjectFor(payload.Image, payload.Digest)}
+	platforms := make([]string, 0, len(payload.PlatformDigests))
+	for platform := range payload.PlatformDigests {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	for _, platform := range platforms {
+		if digest := payload.PlatformDigests[platform]; digest != payload.Digest {
+			subjects = append(subjects, subjectFor(payload.Image, digest))
+		}
+	}
+
+	details := spec.BuildConfig.Details.OCIBuildDetails
+	definition := SLSABuildDefinition{
+		BuildType: fmt.Sprintf(argonautBuildTypeFmt, spec.BuildConfig.BuildType),
+		ExternalParameters: map[string]interface{}{
+			"buildConfig": map[string]interface{}{
+				"id":             spec.BuildConfig.Id,
+				"name":           spec.BuildConfig.Name,
+				"buildType":      spec.BuildConfig.BuildType,
+				"dockerFilePath": details.DockerFilePath,
+				"workingDir":     details.WorkingDir,
+				"builder":        details.Builder,
+				"runImage":       details.RunImage,
+				"platforms":      details.Platforms,
+			},
+			"buildRun": map[string]interface{}{
+				"id":    spec.BuildRun.Id,
+				"ciRef": spec.BuildRun.CIRef,
+			},
+		},
+		InternalParameters: map[string]interface{}{
+			"tags":   payload.ImageTags,
+			"engine": "dagger",
+		},
+	}
+	if checkout != nil {
+		uri := "git+" + checkout.Remote
+		if checkout.Remote == "" {
+			uri = "argonaut:repo/" + spec.BuildConfig.RepoId
+		}
+		definition.ResolvedDependencies = []SLSAResource{{
+			URI:    uri,
+			Digest: map[string]string{"gitCommit": checkout.CommitSha},
+		}}
+	}
+
+	return &InTotoStatement{
+		Type:          InTotoStatementType,
+		Subject:       subjects,
+		PredicateType: SLSAProvenanceType,
+		Predicate: SLSAProvenance{
+			BuildDefinition: definition,
+			RunDetails: SLSARunDetails{
+				Builder: SLSABuilder{
+					ID:      ARGONAUT_BUILDER_ID,
+					Version: map[string]string{"argonaut-action": version, "revision": buildRevision()},
+				},
+				Metadata: SLSAMetadata{
+					InvocationID: spec.BuildRun.Id,
+					StartedOn:    started.UTC(),
+					FinishedOn:   finished.UTC(),
+				},
+			},
+		},
+	}
+}
+
+func subjectFor(image string, digest string) InTotoSubject {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return InTotoSubject{Name: image, Digest: map[string]string{algorithm: hex}}
+}
+
+// attachProvenance writes the provenance statement to dir and pushes it to the
+// registry as an artifact referring to the image.
+func attachProvenance(access *RegistryAccess, spec *buildSpec, checkout *RepoCheckout, payload *BuildRunCallbackPayload, started time.Time, dir string) error {
+	statement := provenanceStatement(spec, checkout, payload, started, time.Now())
+	content, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "provenance.json")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("provenance written : [%s] \n", path)
+
+	registry := newRegistryClient(access)
+	subject, err := registry.Describe(payload.Image, payload.Digest)
+	if err != nil {
+		return err
+	}
+	desc, err := registry.PushReferrer(payload.Image, subject, MediaTypeInToto, content, map[string]string{
+		"in-toto.io/predicate-type": SLSAProvenanceType,
+	})
+	if err != nil {
+		return err
+	}
+
+	payload.ProvenanceRef = fmt.Sprintf("%s@%s", payload.Image, desc.Digest)
+	fmt.Printf("provenance pushed : [%s] \n", payload.ProvenanceRef)
+	return nil
+}
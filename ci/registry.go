@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIEmpty           = "application/vnd.oci.empty.v1+json"
+)
+
+var ErrManifestUnknown = errors.New("manifest unknown")
+
+// emptyConfig is the config blob of artifact manifests that have no config.
+var emptyConfig = []byte("{}")
+
+var manifestAcceptHeader = strings.Join([]string{
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}, ", ")
+
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Platform     *ImagePlatform    `json:"platform,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type ImagePlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p ImagePlatform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// Manifest covers both image manifests and indexes; which fields are set
+// depends on MediaType.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *Descriptor       `json:"config,omitempty"`
+	Layers        []Descriptor      `json:"layers,omitempty"`
+	Manifests     []Descriptor      `json:"manifests,omitempty"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+func (m *Manifest) IsIndex() bool {
+	return m.MediaType == MediaTypeOCIIndex || m.MediaType == MediaTypeDockerManifestList || len(m.Manifests) > 0
+}
+
+// registryClient talks the OCI distribution API with the credentials from
+// RegistryAccess, following the bearer token challenge when one is issued.
+type registryClient struct {
+	client   *resty.Client
+	host     string
+	username string
+	password string
+
+	mu    sync.Mutex
+	token map[string]string
+}
+
+func newRegistryClient(access *RegistryAccess) *registryClient {
+	host := registryHost(access)
+	scheme := "https"
+	if strings.HasPrefix(access.Url, "http://") || strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		scheme = "http"
+	}
+
+	return &registryClient{
+		client:   resty.New().SetBaseURL(fmt.Sprintf("%s://%s", scheme, host)),
+		host:     host,
+		username: access.Username,
+		password: access.Password,
+		token:    map[string]string{},
+	}
+}
+
+// registryHost is the registry address images under access are pushed to.
+func registryHost(access *RegistryAccess) string {
+	raw := access.Url
+	if raw == "" {
+		raw = access.UrlWithPrefix
+	}
+	return strings.SplitN(stripScheme(raw), "/", 2)[0]
+}
+
+func stripScheme(url string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://")
+}
+
+// repository returns the repository path of image inside this registry.
+func (r *registryClient) repository(image string) string {
+	return strings.TrimPrefix(stripScheme(image), r.host+"/")
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// do sends the request, answering a 401 challenge once with basic auth or a
+// bearer token obtained from the advertised realm.
+func (r *registryClient) do(repo string, build func(req *resty.Request) (*resty.Response, error)) (*resty.Response, error) {
+	r.mu.Lock()
+	token := r.token[repo]
+	r.mu.Unlock()
+
+	req := r.client.R()
+	r.authorize(req, token)
+	resp, err := build(req)
+	if err != nil || resp.StatusCode() != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header().Get("WWW-Authenticate")
+	if strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		token, err = r.fetchToken(challenge)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.token[repo] = token
+		r.mu.Unlock()
+	} else {
+		token = ""
+	}
+
+	req = r.client.R()
+	r.authorize(req, token)
+	return build(req)
+}
+
+func (r *registryClient) authorize(req *resty.Request, token string) {
+	if token != "" {
+		req.SetAuthToken(token)
+	} else if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+}
+
+func (r *registryClient) fetchToken(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("registry auth challenge without realm : [%s]", challenge)
+	}
+
+	req := resty.New().R()
+	if params["service"] != "" {
+		req.SetQueryParam("service", params["service"])
+	}
+	if params["scope"] != "" {
+		req.SetQueryParam("scope", params["scope"])
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := req.Get(realm)
+	if err != nil {
+		return "", err
+	}
+	if resp.IsError() {
+		return "", fmt.Errorf("registry token request failed : [%d] %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	out := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(resp.Body(), &out); err != nil {
+		return "", err
+	}
+	if out.Token != "" {
+		return out.Token, nil
+	}
+	if out.AccessToken != "" {
+		return out.AccessToken, nil
+	}
+	return "", errors.New("registry token response without token")
+}
+
+// GetManifest fetches a manifest or index by tag or digest.
+func (r *registryClient) GetManifest(image string, reference string) (*Manifest, []byte, error) {
+	repo := r.repository(image)
+	resp, err := r.do(repo, func(req *resty.Request) (*resty.Response, error) {
+		return req.SetHeader("Accept", manifestAcceptHeader).
+			Get(fmt.Sprintf("/v2/%s/manifests/%s", repo, reference))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, nil, fmt.Errorf("%w : [%s]", ErrManifestUnknown, reference)
+	}
+	if resp.IsError() {
+		return nil, nil, fmt.Errorf("registry manifest request failed : [%d] %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	manifest := Manifest{}
+	if err := json.Unmarshal(resp.Body(), &manifest); err != nil {
+		return nil, nil, err
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = strings.Split(resp.Header().Get("Content-Type"), ";")[0]
+	}
+	return &manifest, resp.Body(), nil
+}
+
+// PushBlob uploads content unless the registry already has it.
+func (r *registryClient) PushBlob(image string, mediaType string, content []byte) (Descriptor, error) {
+	repo := r.repository(image)
+	desc := Descriptor{MediaType: mediaType, Digest: digestOf(content), Size: int64(len(content))}
+
+	resp, err := r.do(repo, func(req *resty.Request) (*resty.Response, error) {
+		return req.Head(fmt.Sprintf("/v2/%s/blobs/%s", repo, desc.Digest))
+	})
+	if err != nil {
+		return desc, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return desc, nil
+	}
+
+	resp, err = r.do(repo, func(req *resty.Request) (*resty.Response, error) {
+		return req.Post(fmt.Sprintf("/v2/%s/blobs/uploads/", repo))
+	})
+	if err != nil {
+		return desc, err
+	}
+	if resp.StatusCode() != http.StatusAccepted {
+		return desc, fmt.Errorf("registry blob upload failed : [%d] %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	location := resp.Header().Get("Location")
+	if location == "" {
+		return desc, errors.New("registry blob upload without location")
+	}
+	resp, err = r.do(repo, func(req *resty.Request) (*resty.Response, error) {
+		return req.SetHeader("Content-Type", "application/octet-stream").
+			SetQueryParam("digest", desc.Digest).
+			SetBody(content).
+			Put(location)
+	})
+	if err != nil {
+		return desc, err
+	}
+	if resp.StatusCode() != http.StatusCreated {
+		return desc, fmt.Errorf("registry blob upload failed : [%d] %s", resp.StatusCode(), string(resp.Body()))
+	}
+	return desc, nil
+}
+
+// PutManifest stores manifest under reference, a tag or its digest. The
+// second result reports whether the registry indexed the manifest subject,
+// i.e. supports the referrers API.
+func (r *registryClient) PutManifest(image string, reference string, manifest *Manifest) (Descriptor, bool, error) {
+	repo := r.repository(image)
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return Descriptor{}, false, err
+	}
+	desc := Descriptor{MediaType: manifest.MediaType, Digest: digestOf(body), Size: int64(len(body))}
+	if reference == "" {
+		reference = desc.Digest
+	}
+
+	resp, err := r.do(repo, func(req *resty.Request) (*resty.Response, error) {
+		return req.SetHeader("Content-Type", manifest.MediaType).
+			SetBody(body).
+			Put(fmt.Sprintf("/v2/%s/manifests/%s", repo, reference))
+	})
+	if err != nil {
+		return desc, false, err
+	}
+	if resp.StatusCode() != http.StatusCreated {
+		return desc, false, fmt.Errorf("registry manifest upload failed : [%d] %s", resp.StatusCode(), string(resp.Body()))
+	}
+	return desc, resp.Header().Get("OCI-Subject") != "", nil
+}
+
+// PushReferrer pushes an artifact holding content that refers to subject.
+// Registries without the referrers API find it through the fallback index
+// tagged sha256-<hex>, as the OCI distribution spec describes.
+func (r *registryClient) PushReferrer(image string, subject Descriptor, artifactType string, content []byte, annotations map[string]string) (Descriptor, error) {
+	config, err := r.PushBlob(image, MediaTypeOCIEmpty, emptyConfig)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	layer, err := r.PushBlob(image, artifactType, content)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        &config,
+		Layers:        []Descriptor{layer},
+		Subject:       &Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+		Annotations:   annotations,
+	}
+	desc, indexed, err := r.PutManifest(image, "", manifest)
+	if err != nil || indexed {
+		return desc, err
+	}
+
+	desc.ArtifactType = artifactType
+	desc.Annotations = annotations
+	return desc, r.addToReferrersTag(image, subject.Digest, desc)
+}
+
+func (r *registryClient) addToReferrersTag(image string, subjectDigest string, referrer Descriptor) error {
+	tag := strings.Replace(subjectDigest, ":", "-", 1)
+	index, _, err := r.GetManifest(image, tag)
+	if errors.Is(err, ErrManifestUnknown) {
+		index = &Manifest{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+	} else if err != nil {
+		return err
+	}
+	for _, existing := range index.Manifests {
+		if existing.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+	_, _, err = r.PutManifest(image, tag, index)
+	return err
+}
+
+// Describe returns the descriptor of the manifest at reference.
+func (r *registryClient) Describe(image string, reference string) (Descriptor, error) {
+	manifest, body, err := r.GetManifest(image, reference)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{MediaType: manifest.MediaType, Digest: digestOf(body), Size: int64(len(body))}, nil
+}
+
+func digestOf(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// splitDigest extracts the digest from a reference like name:tag@sha256:...
+func splitDigest(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// withRegistryAuth attaches the registry credentials to container for pulls
+// from and publishes to the build's registry.
+// The password only ever travels as a Dagger secret.
+func withRegistryAuth(client *dagger.Client, container *dagger.Container, access *RegistryAccess) *dagger.Container {
+	if access == nil || access.Username == "" {
+		return container
+	}
+	password := client.SetSecret("registry-password", access.Password)
+	return container.WithRegistryAuth(registryHost(access), access.Username, password)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	DEFAULT_RETRY_ATTEMPTS   = 4
+	DEFAULT_RETRY_BASE_DELAY = 500 * time.Millisecond
+	DEFAULT_RETRY_MAX_DELAY  = 10 * time.Second
+	DEFAULT_RETRY_BUDGET     = time.Minute
+)
+
+type retryStartKey struct{}
+
+// RetryPolicy controls how requests to the argonaut backend are retried:
+// exponential backoff with jitter between BaseDelay and MaxDelay, at most
+// Attempts tries in total, and no new attempt once Budget has passed since
+// the first one.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Budget    time.Duration
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:  DEFAULT_RETRY_ATTEMPTS,
+		BaseDelay: DEFAULT_RETRY_BASE_DELAY,
+		MaxDelay:  DEFAULT_RETRY_MAX_DELAY,
+		Budget:    DEFAULT_RETRY_BUDGET,
+	}
+}
+
+// apply configures client with the policy. resty computes the jittered
+// backoff; a Retry-After header replaces it. A server asking for a longer wait
+// than MaxDelay or the rest of the budget gets no retry at all.
+func (p RetryPolicy) apply(client *resty.Client) {
+	// resty counts every retry, one more than the policy allows is reserved for
+	// the token refresh after a 401, which also runs inside resty's retry loop
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	client.SetRetryCount(attempts).
+		SetRetryWaitTime(p.BaseDelay).
+		SetRetryMaxWaitTime(p.MaxDelay).
+		SetRetryAfter(retryAfter).
+		OnBeforeRequest(markRetryStart).
+		AddRetryCondition(p.shouldRetry)
+}
+
+// markRetryStart records when the first attempt of a request was sent, later
+// attempts keep the value.
+func markRetryStart(c *resty.Client, req *resty.Request) error {
+	if req.Context().Value(retryStartKey{}) == nil {
+		req.SetContext(context.WithValue(req.Context(), retryStartKey{}, time.Now()))
+	}
+	return nil
+}
+
+func (p RetryPolicy) shouldRetry(res *resty.Response, reqErr error) bool {
+	if res == nil || res.Request == nil {
+		return false
+	}
+	req := res.Request
+
+	retryable := reqErr != nil || res.StatusCode() == http.StatusTooManyRequests || res.StatusCode() >= 500
+	if !retryable {
+		return false
+	}
+	if reqErr != nil {
+		logRequestTrace(res, reqErr)
+	}
+
+	if policyAttempts(req) >= p.Attempts {
+		return false
+	}
+
+	// a callback or upload that is not marked idempotent may already have been
+	// applied, sending it again could apply it twice
+	if !idempotent(req) {
+		fmt.Printf("not retrying %s %s, the request is not idempotent : [%v] \n", req.Method, req.URL, retryReason(res, reqErr))
+		return false
+	}
+	wait := retryAfterHeader(res)
+	if wait > p.MaxDelay {
+		fmt.Printf("not retrying %s %s, the server asks to wait %s : [%v] \n", req.Method, req.URL, wait, retryReason(res, reqErr))
+		return false
+	}
+	if start, ok := req.Context().Value(retryStartKey{}).(time.Time); ok && p.Budget > 0 && time.Since(start)+wait >= p.Budget {
+		fmt.Printf("not retrying %s %s, the retry budget of %s would be exceeded : [%v] \n", req.Method, req.URL, p.Budget, retryReason(res, reqErr))
+		return false
+	}
+
+	fmt.Printf("retrying %s %s after attempt %d : [%v] \n", req.Method, req.URL, req.Attempt, retryReason(res, reqErr))
+	return true
+}
+
+// policyAttempts is the number of attempts made so far, not counting the
+// retry after a token refresh.
+func policyAttempts(req *resty.Request) int {
+	if req.Context().Value(authRetriedKey{}) != nil {
+		return req.Attempt - 1
+	}
+	return req.Attempt
+}
+
+func idempotent(req *resty.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func retryReason(res *resty.Response, reqErr error) string {
+	if reqErr != nil {
+		return reqErr.Error()
+	}
+	return res.Status()
+}
+
+// retryAfter honors a Retry-After header, shouldRetry already refused waits
+// beyond MaxDelay. Zero falls back to the backoff.
+func retryAfter(c *resty.Client, res *resty.Response) (time.Duration, error) {
+	return retryAfterHeader(res), nil
+}
+
+// retryAfterHeader reads a Retry-After header in seconds or as an http date,
+// zero when there is none.
+func retryAfterHeader(res *resty.Response) time.Duration {
+	if res == nil || res.RawResponse == nil {
+		return 0
+	}
+	value := res.Header().Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func logRequestTrace(res *resty.Response, reqErr error) {
+	fmt.Printf("Request trace info for err. Err: %v  \n", reqErr)
+	fmt.Printf("Trace Info :  \n")
+	ti := res.Request.TraceInfo()
+	fmt.Printf("  Content size  : %v  \n", res.Request.Header["Content-Length"])
+	fmt.Printf("  DNSLookup     : %v  \n", ti.DNSLookup)
+	fmt.Printf("  ConnTime      : %v  \n", ti.ConnTime)
+	fmt.Printf("  TCPConnTime   : %v  \n", ti.TCPConnTime)
+	fmt.Printf("  TLSHandshake  : %v  \n", ti.TLSHandshake)
+	fmt.Printf("  ServerTime    : %v  \n", ti.ServerTime)
+	fmt.Printf("  ResponseTime  : %v \n", ti.ResponseTime)
+	fmt.Printf("  TotalTime     : %v \n", ti.TotalTime)
+	fmt.Printf("  IsConnReused  : %v \n", ti.IsConnReused)
+	fmt.Printf("  IsConnWasIdle : %v \n", ti.IsConnWasIdle)
+	fmt.Printf("  ConnIdleTime  : %v \n", ti.ConnIdleTime)
+	fmt.Printf("  Resp Time       : %v \n", res.Time())
+	fmt.Printf("  Resp Received At: %v \n", res.ReceivedAt())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func testResponse(method string, status int, header http.Header, attempt int) *resty.Response {
+	req := resty.New().R()
+	req.Method = method
+	req.URL = "/api/v1/test"
+	req.Attempt = attempt
+	if header == nil {
+		header = http.Header{}
+	}
+	return &resty.Response{Request: req, RawResponse: &http.Response{StatusCode: status, Header: header}}
+}
+
+func TestShouldRetry(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 10 * time.Second, Budget: time.Minute}
+
+	tests := []struct {
+		name   string
+		res    *resty.Response
+		reqErr error
+		setup  func(res *resty.Response)
+		want   bool
+	}{
+		{name: "get 503", res: testResponse(http.MethodGet, 503, nil, 1), want: true},
+		{name: "get 429", res: testResponse(http.MethodGet, 429, nil, 1), want: true},
+		{name: "get 500 last attempt", res: testResponse(http.MethodGet, 500, nil, 3), want: false},
+		{name: "get 404", res: testResponse(http.MethodGet, 404, nil, 1), want: false},
+		{name: "get 401 left to the token refresh", res: testResponse(http.MethodGet, 401, nil, 1), want: false},
+		{name: "get 200", res: testResponse(http.MethodGet, 200, nil, 1), want: false},
+		{name: "get network error", res: testResponse(http.MethodGet, 0, nil, 1), reqErr: errors.New("connection reset"), want: true},
+		{name: "post 503 without key", res: testResponse(http.MethodPost, 503, nil, 1), want: false},
+		{name: "post network error without key", res: testResponse(http.MethodPost, 0, nil, 1), reqErr: errors.New("connection reset"), want: false},
+		{
+			name: "post 503 with key",
+			res:  testResponse(http.MethodPost, 503, nil, 1),
+			setup: func(res *resty.Response) {
+				res.Request.SetHeader("Idempotency-Key", "key")
+			},
+			want: true,
+		},
+		{name: "retry after within max delay", res: testResponse(http.MethodGet, 429, http.Header{"Retry-After": []string{"5"}}, 1), want: true},
+		{name: "retry after beyond max delay", res: testResponse(http.MethodGet, 429, http.Header{"Retry-After": []string{"60"}}, 1), want: false},
+		{
+			name: "budget spent",
+			res:  testResponse(http.MethodGet, 503, nil, 1),
+			setup: func(res *resty.Response) {
+				res.Request.SetContext(context.WithValue(context.Background(), retryStartKey{}, time.Now().Add(-2*time.Minute)))
+			},
+			want: false,
+		},
+		{
+			name: "retry after beyond remaining budget",
+			res:  testResponse(http.MethodGet, 503, http.Header{"Retry-After": []string{"8"}}, 1),
+			setup: func(res *resty.Response) {
+				res.Request.SetContext(context.WithValue(context.Background(), retryStartKey{}, time.Now().Add(-55*time.Second)))
+			},
+			want: false,
+		},
+		{
+			name: "token refresh does not use up an attempt",
+			res:  testResponse(http.MethodPut, 502, nil, 3),
+			setup: func(res *resty.Response) {
+				res.Request.SetContext(context.WithValue(context.Background(), authRetriedKey{}, true))
+			},
+			want: true,
+		},
+		{name: "nil response", res: nil, reqErr: errors.New("no response"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup(tt.res)
+			}
+			if got := policy.shouldRetry(tt.res, tt.reqErr); got != tt.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		method string
+		key    string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodPut, "", true},
+		{http.MethodDelete, "", true},
+		{http.MethodPost, "", false},
+		{http.MethodPatch, "", false},
+		{http.MethodPost, "key", true},
+	}
+	for _, tt := range tests {
+		req := resty.New().R()
+		req.Method = tt.method
+		if tt.key != "" {
+			req.SetHeader("Idempotency-Key", tt.key)
+		}
+		if got := idempotent(req); got != tt.want {
+			t.Errorf("idempotent(%s, key %q) = %v, want %v", tt.method, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "none", value: "", min: 0, max: 0},
+		{name: "seconds", value: "7", min: 7 * time.Second, max: 7 * time.Second},
+		{name: "zero", value: "0", min: 0, max: 0},
+		{name: "garbage", value: "soon", min: 0, max: 0},
+		{name: "http date", value: time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), min: 28 * time.Second, max: 30 * time.Second},
+		{name: "past http date", value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: 0, max: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			got, err := retryAfter(nil, testResponse(http.MethodGet, 429, header, 1))
+			if err != nil {
+				t.Fatalf("retryAfter() error = %v", err)
+			}
+			if got < tt.min || got > tt.max {
+				t.Errorf("retryAfter() = %s, want between %s and %s", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := resty.New().SetBaseURL(server.URL)
+	RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Budget: time.Minute}.apply(client)
+	resp, err := client.R().Get("/")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if resp.StatusCode() != http.StatusServiceUnavailable || calls != 2 {
+		t.Errorf("got status %d after %d calls, want 503 after 2", resp.StatusCode(), calls)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+const MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+
+// imageSBOM is the CycloneDX document of one platform image.
+type imageSBOM struct {
+	Platform dagger.Platform
+	Content  []byte
+}
+
+// generateSBOMs catalogs every variant with syft: the image filesystem for OS
+// and installed packages, and the build context for language lockfiles.
+func generateSBOMs(ctx context.Context, client *dagger.Client, targets []dagger.Platform, variants []*dagger.Container, contextDir *dagger.Directory) ([]*imageSBOM, error) {
+	// the context and every platform are scanned in parallel, like the variants
+	// were built
+	var source []byte
+	var sourceErr error
+	images := make([][]byte, len(variants))
+	errs := make([]error, len(variants))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		source, sourceErr = syftScan(ctx, client, contextDir)
+	}()
+	for i, variant := range variants {
+		wg.Add(1)
+		go func(i int, variant *dagger.Container) {
+			defer wg.Done()
+			images[i], errs[i] = syftScan(ctx, client, variant.Rootfs())
+			if errs[i] != nil && targets[i] != "" {
+				errs[i] = fmt.Errorf("platform [%s] : %w", targets[i], errs[i])
+			}
+		}(i, variant)
+	}
+	wg.Wait()
+
+	if sourceErr != nil {
+		return nil, fmt.Errorf("sbom of build context : %w", sourceErr)
+	}
+	sboms := []*imageSBOM{}
+	for i, image := range images {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("sbom of image : %w", errs[i])
+		}
+		content, err := mergeCycloneDX(image, source)
+		if err != nil {
+			return nil, err
+		}
+		sboms = append(sboms, &imageSBOM{Platform: targets[i], Content: content})
+	}
+	return sboms, nil
+}
+
+func syftScan(ctx context.Context, client *dagger.Client, dir *dagger.Directory) ([]byte, error) {
+	out, err := client.Container().From(SYFT_IMAGE).
+		WithEntrypoint([]string{}).
+		WithMountedDirectory("/scan", dir).
+		WithExec([]string{"/syft", "dir:/scan", "--quiet", "--output", "cyclonedx-json=/tmp/sbom.json"}).
+		File("/tmp/sbom.json").
+		Contents(ctx)
+	return []byte(out), err
+}
+
+// mergeCycloneDX adds the components of the other documents to the first one,
+// skipping packages it already lists.
+func mergeCycloneDX(first []byte, others ...[]byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(first, &doc); err != nil {
+		return nil, err
+	}
+	components, _ := doc["components"].([]interface{})
+
+	seen := map[string]bool{}
+	for _, component := range components {
+		seen[componentKey(component)] = true
+	}
+	for _, other := range others {
+		otherDoc := map[string]interface{}{}
+		if err := json.Unmarshal(other, &otherDoc); err != nil {
+			return nil, err
+		}
+		otherComponents, _ := otherDoc["components"].([]interface{})
+		for _, component := range otherComponents {
+			if key := componentKey(component); !seen[key] {
+				seen[key] = true
+				components = append(components, component)
+			}
+		}
+	}
+
+	doc["components"] = components
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func componentKey(component interface{}) string {
+	fields, _ := component.(map[string]interface{})
+	if purl, _ := fields["purl"].(string); purl != "" {
+		return purl
+	}
+	return fmt.Sprintf("%v@%v", fields["name"], fields["version"])
+}
+
+// summarizeSBOM counts the packages of the documents by ecosystem, the purl
+// type such as deb, npm or golang.
+func summarizeSBOM(sboms []*imageSBOM) (*SBOMSummary, error) {
+	summary := &SBOMSummary{Format: "cyclonedx-json", Ecosystems: map[string]int{}}
+	seen := map[string]bool{}
+	for _, sbom := range sboms {
+		doc := struct {
+			Components []struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+				Purl    string `json:"purl"`
+			} `json:"components"`
+		}{}
+		if err := json.Unmarshal(sbom.Content, &doc); err != nil {
+			return nil, err
+		}
+		for _, component := range doc.Components {
+			if component.Purl == "" {
+				// files and the scanned directory itself, not packages
+				continue
+			}
+			if seen[component.Purl] {
+				continue
+			}
+			seen[component.Purl] = true
+			ecosystem := strings.SplitN(strings.TrimPrefix(component.Purl, "pkg:"), "/", 2)[0]
+			summary.Ecosystems[ecosystem]++
+			summary.PackageCount++
+		}
+	}
+	return summary, nil
+}
+
+// writeSBOMs saves the documents to dir, one per platform.
+func writeSBOMs(sboms []*imageSBOM, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, sbom := range sboms {
+		name := "sbom.cdx.json"
+		if sbom.Platform != "" {
+			name = fmt.Sprintf("sbom-%s.cdx.json", strings.ReplaceAll(string(sbom.Platform), "/", "-"))
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, sbom.Content, 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// attachSBOMs pushes each document as a referrer of its platform image and,
+// for a manifest list, of the list as well.
+func attachSBOMs(access *RegistryAccess, image string, payload *BuildRunCallbackPayload, sboms []*imageSBOM) error {
+	registry := newRegistryClient(access)
+
+	subjects := map[string]bool{}
+	for _, sbom := range sboms {
+		digests := []string{payload.Digest}
+		if platformDigest := payload.PlatformDigests[string(sbom.Platform)]; platformDigest != "" && platformDigest != payload.Digest {
+			digests = append(digests, platformDigest)
+		}
+
+		annotations := map[string]string{}
+		if sbom.Platform != "" {
+			annotations["dev.argonaut.platform"] = string(sbom.Platform)
+		}
+		for _, digest := range digests {
+			subject, err := registry.Describe(image, digest)
+			if err != nil {
+				return err
+			}
+			desc, err := registry.PushReferrer(image, subject, MediaTypeCycloneDX, sbom.Content, annotations)
+			if err != nil {
+				return err
+			}
+			ref := fmt.Sprintf("%s@%s", image, desc.Digest)
+			if !subjects[ref] {
+				subjects[ref] = true
+				payload.SBOM.Refs = append(payload.SBOM.Refs, ref)
+			}
+		}
+	}
+	sort.Strings(payload.SBOM.Refs)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	DEFAULT_SCAN_THRESHOLD = "high"
+
+	scanReportLimit = 200
+	scanErrorLimit  = 10
+)
+
+// severityRank orders grype severities; unknown ones rank lowest.
+var severityRank = map[string]int{
+	"negligible": 1,
+	"low":        2,
+	"medium":     3,
+	"high":       4,
+	"critical":   5,
+}
+
+// scanImages matches the SBOM of every platform against the offline grype
+// database at dbPath, a database directory or an archive to import.
+func scanImages(ctx context.Context, client *dagger.Client, sboms []*imageSBOM, dbPath string, config ScanConfig) (*ScanReport, error) {
+	if dbPath == "" {
+		return nil, errors.New("vulnerability scan is enabled but no database is configured, set --vuln-db")
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("vulnerability database : %w", err)
+	}
+
+	threshold := strings.ToLower(config.FailOn)
+	if threshold == "" {
+		threshold = DEFAULT_SCAN_THRESHOLD
+	}
+	if _, ok := severityRank[threshold]; !ok {
+		return nil, fmt.Errorf("unknown scan severity threshold [%s]", config.FailOn)
+	}
+
+	scanner := client.Container().From(GRYPE_IMAGE).
+		WithEntrypoint([]string{}).
+		WithEnvVariable("GRYPE_DB_AUTO_UPDATE", "false").
+		WithEnvVariable("GRYPE_DB_VALIDATE_AGE", "false").
+		WithEnvVariable("GRYPE_DB_CACHE_DIR", "/db")
+	if info.IsDir() {
+		scanner = scanner.WithMountedDirectory("/db", client.Host().Directory(dbPath))
+	} else {
+		archive := client.Host().Directory(filepath.Dir(dbPath)).File(filepath.Base(dbPath))
+		scanner = scanner.
+			WithMountedFile("/vulnerability-db.tar.gz", archive).
+			WithExec([]string{"/grype", "db", "import", "/vulnerability-db.tar.gz"})
+	}
+
+	report := &ScanReport{Database: filepath.Base(dbPath), Threshold: threshold, Counts: map[string]int{}, Passed: true}
+	for _, sbom := range sboms {
+		out, err := scanner.
+			WithNewFile("/sbom.json", dagger.ContainerWithNewFileOpts{Contents: string(sbom.Content)}).
+			WithExec([]string{"/grype", "sbom:/sbom.json", "--output", "json", "--file", "/tmp/report.json"}).
+			File("/tmp/report.json").
+			Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("vulnerability scan : %w", err)
+		}
+		if err := report.add(out, string(sbom.Platform), config.IgnoreUnfixed); err != nil {
+			return nil, err
+		}
+	}
+
+	report.finish()
+	return report, nil
+}
+
+// add records the matches of one grype json report.
+func (r *ScanReport) add(out string, platform string, ignoreUnfixed bool) error {
+	grype := struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+				Fix      struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+				Type    string `json:"type"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &grype); err != nil {
+		return fmt.Errorf("vulnerability scan report : %w", err)
+	}
+
+	for _, match := range grype.Matches {
+		if ignoreUnfixed && len(match.Vulnerability.Fix.Versions) == 0 {
+			continue
+		}
+		severity := strings.ToLower(match.Vulnerability.Severity)
+		r.Counts[severity]++
+		finding := ScanFinding{
+			ID:       match.Vulnerability.ID,
+			Severity: severity,
+			Package:  match.Artifact.Name,
+			Version:  match.Artifact.Version,
+			Type:     match.Artifact.Type,
+			FixedIn:  strings.Join(match.Vulnerability.Fix.Versions, ", "),
+			Platform: platform,
+		}
+		if severityRank[severity] >= severityRank[r.Threshold] {
+			r.Passed = false
+			r.BlockingCount++
+			finding.Blocking = true
+		}
+		r.Findings = append(r.Findings, finding)
+	}
+	return nil
+}
+
+// finish orders the findings, most severe first, and caps the list so the
+// callback stays small; Counts keeps the totals.
+func (r *ScanReport) finish() {
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		return severityRank[r.Findings[i].Severity] > severityRank[r.Findings[j].Severity]
+	})
+	if len(r.Findings) > scanReportLimit {
+		r.Findings = r.Findings[:scanReportLimit]
+		r.Truncated = true
+	}
+}
+
+// gateError lists the findings that fail the scan.
+func (r *ScanReport) gateError() error {
+	if r.Passed {
+		return nil
+	}
+	blocking := []string{}
+	for _, finding := range r.Findings {
+		if finding.Blocking && len(blocking) < scanErrorLimit {
+			blocking = append(blocking, fmt.Sprintf("%s (%s) in %s %s", finding.ID, finding.Severity, finding.Package, finding.Version))
+		}
+	}
+	more := ""
+	if r.BlockingCount > len(blocking) {
+		more = fmt.Sprintf(" and %d more", r.BlockingCount-len(blocking))
+	}
+	return fmt.Errorf("vulnerability scan found %d findings at or above [%s] : %s%s", r.BlockingCount, r.Threshold, strings.Join(blocking, "; "), more)
+}
+
+func writeScanReport(report *ScanReport, dir string) (string, error) {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "scan-report.json")
+	return path, os.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+const secretMountDir = "/run/secrets"
+
+// buildSecret is a build time secret delivered as a Dagger secret.
+type buildSecret struct {
+	Key   string
+	Mode  SecretMode
+	value string
+}
+
+// secret registers the value with the session under the secret key, the id a
+// Dockerfile mounts it by.
+func (b buildSecret) secret(client *dagger.Client) *dagger.Secret {
+	return client.SetSecret(b.Key, b.value)
+}
+
+// planBuildSecrets splits secrets into plain build args and Dagger secrets
+// according to the modes in the build config. Only secrets explicitly marked
+// build_arg become build args.
+func planBuildSecrets(buildType BuildType, details OCIBuildDetails, secrets []BuildSecret) ([]dagger.BuildArg, []buildSecret, error) {
+	buildArgs := []dagger.BuildArg{}
+	mounted := []buildSecret{}
+
+	for _, secret := range secrets {
+		mode, ok := details.SecretModes[secret.Key]
+		if !ok {
+			mode = defaultSecretMode(buildType)
+		}
+
+		switch mode {
+		case SecretBuildArg:
+			fmt.Printf("secret [%s] is passed as a plain build arg and is visible in the image history \n", secret.Key)
+			buildArgs = append(buildArgs, dagger.BuildArg{Name: secret.Key, Value: secret.Value})
+		case SecretEnv:
+			if buildType == Docker {
+				return nil, nil, fmt.Errorf("secret [%s] : mode [%s] is not supported for docker builds, use [%s] and RUN --mount=type=secret,id=%s", secret.Key, mode, SecretFile, secret.Key)
+			}
+			mounted = append(mounted, buildSecret{Key: secret.Key, Mode: mode, value: secret.Value})
+		case SecretFile:
+			if buildType == Docker {
+				fmt.Printf("secret [%s] is available to RUN --mount=type=secret,id=%s at %s/%s \n", secret.Key, secret.Key, secretMountDir, secret.Key)
+			}
+			mounted = append(mounted, buildSecret{Key: secret.Key, Mode: mode, value: secret.Value})
+		default:
+			return nil, nil, fmt.Errorf("secret [%s] : unknown mode [%s]", secret.Key, mode)
+		}
+	}
+	return buildArgs, mounted, nil
+}
+
+func defaultSecretMode(buildType BuildType) SecretMode {
+	if buildType == Docker {
+		return SecretFile
+	}
+	return SecretEnv
+}
+
+// dockerBuildSecrets returns the secrets for the Dockerfile frontend, which
+// mounts them at /run/secrets/<key> for RUN --mount=type=secret,id=<key>.
+func dockerBuildSecrets(client *dagger.Client, secrets []buildSecret) []*dagger.Secret {
+	out := []*dagger.Secret{}
+	for _, secret := range secrets {
+		out = append(out, secret.secret(client))
+	}
+	return out
+}
+
+// withBuildSecrets mounts secrets readable by owner inside container: env
+// secrets as files in envDir, where the consumer reads one variable per file,
+// and file secrets under /run/secrets. Mounts never become part of a layer.
+func withBuildSecrets(client *dagger.Client, container *dagger.Container, owner string, envDir string, secrets []buildSecret) *dagger.Container {
+	for _, secret := range secrets {
+		dir := secretMountDir
+		if secret.Mode == SecretEnv {
+			dir = envDir
+		}
+		container = container.WithMountedSecret(filepath.Join(dir, secret.Key), secret.secret(client), dagger.ContainerWithMountedSecretOpts{Owner: owner})
+	}
+	return container
+}
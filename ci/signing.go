@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	MediaTypeOCIConfig         = "application/vnd.oci.image.config.v1+json"
+	MediaTypeCosignSimpleSign  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation  = "dev.cosignproject.cosign/signature"
+	cosignSignatureType        = "cosign container image signature"
+	cosignEncryptedKeyPEMBlock = "ENCRYPTED COSIGN PRIVATE KEY"
+)
+
+// simpleSigning is the payload cosign signs and verifies for an image.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// signingKey returns the configured private key, from the build secret named
+// in the signing config or from a key file for local builds, or nil when
+// signing is not configured.
+func signingKey(config SigningConfig, secrets []BuildSecret) (crypto.Signer, error) {
+	var data []byte
+	switch {
+	case config.KeySecret != "":
+		for _, secret := range secrets {
+			if secret.Key == config.KeySecret {
+				data = []byte(secret.Value)
+			}
+		}
+		if data == nil {
+			return nil, fmt.Errorf("signing key secret [%s] not found", config.KeySecret)
+		}
+	case config.KeyFile != "":
+		var err error
+		if data, err = os.ReadFile(config.KeyFile); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return parseSigningKey(data)
+}
+
+// parseSigningKey accepts unencrypted PKCS#8, SEC 1 EC and PKCS#1 RSA keys.
+func parseSigningKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case cosignEncryptedKeyPEMBlock:
+		return nil, errors.New("encrypted cosign keys are not supported, provide the key as unencrypted PKCS#8 PEM")
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing key : %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key of type %T cannot sign", key)
+	}
+	return signer, nil
+}
+
+// sign signs payload the way cosign verifies it for the key type.
+func sign(signer crypto.Signer, payload []byte) ([]byte, error) {
+	switch signer.(type) {
+	case ed25519.PrivateKey:
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		digest := sha256.Sum256(payload)
+		return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", signer)
+	}
+}
+
+// signImage signs the published digest and pushes the signature to the
+// sha256-<hex>.sig tag, where cosign looks it up.
+func signImage(access *RegistryAccess, signer crypto.Signer, image string, digest string) (string, error) {
+	if digest == "" {
+		return "", errors.New("publish did not return a digest")
+	}
+	payload := simpleSigning{}
+	payload.Critical.Identity.DockerReference = image
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = cosignSignatureType
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := sign(signer, content)
+	if err != nil {
+		return "", err
+	}
+
+	registry := newRegistryClient(access)
+	layer, err := registry.PushBlob(image, MediaTypeCosignSimpleSign, content)
+	if err != nil {
+		return "", err
+	}
+	layer.Annotations = map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+
+	// earlier signatures of the same digest stay, cosign checks every layer
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	layers := []Descriptor{}
+	existing, _, err := registry.GetManifest(image, tag)
+	if err != nil && !errors.Is(err, ErrManifestUnknown) {
+		return "", err
+	}
+	if existing != nil {
+		layers = append(layers, existing.Layers...)
+	}
+	layers = append(layers, layer)
+
+	diffIds := make([]string, len(layers))
+	for i, l := range layers {
+		diffIds[i] = l.Digest
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "",
+		"os":           "",
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIds},
+	})
+	if err != nil {
+		return "", err
+	}
+	configDesc, err := registry.PushBlob(image, MediaTypeOCIConfig, config)
+	if err != nil {
+		return "", err
+	}
+
+	desc, _, err := registry.PutManifest(image, tag, &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        &configDesc,
+		Layers:        layers,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s@%s", image, tag, desc.Digest), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_TAG_TEMPLATE  = "{{sha7}}-{{timestamp}}"
+	FALLBACK_TAG_TEMPLATE = "build-{{timestamp}}"
+	DEFAULT_BRANCH        = "main"
+)
+
+var (
+	// any placeholder matches, so a misspelled or capitalized name is reported
+	// as unknown rather than left in the tag
+	tagVariable = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+	tagUnsafe   = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+	semverTag   = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?$`)
+)
+
+func (d OCIBuildDetails) defaultBranch() string {
+	if d.DefaultBranch != "" {
+		return d.DefaultBranch
+	}
+	return DEFAULT_BRANCH
+}
+
+// tagVariables returns the values tag templates can refer to. Values that do
+// not apply to this build, such as semver on an untagged commit, are empty.
+func tagVariables(spec *buildSpec, checkout *RepoCheckout, now time.Time) map[string]string {
+	sha := spec.BuildRun.RepoMeta.CommitSha
+	sha7 := sha
+	if len(sha7) > 7 {
+		sha7 = sha7[:7]
+	}
+
+	vars := map[string]string{
+		"branch":       spec.BuildRun.RepoMeta.Branch,
+		"sha":          sha,
+		"sha7":         sha7,
+		"build_run_id": spec.BuildRun.Id,
+		"timestamp":    now.UTC().Format("20060102150405"),
+		"date":         now.UTC().Format("20060102"),
+	}
+
+	gitTag := ""
+	if checkout != nil {
+		gitTag = checkout.Tag
+	}
+	vars["git_tag"] = gitTag
+	vars["semver"], vars["semver_major"], vars["semver_minor"] = "", "", ""
+	if match := semverTag.FindStringSubmatch(gitTag); match != nil {
+		vars["semver"] = strings.TrimPrefix(gitTag, "v")
+		vars["semver_major"] = match[1]
+		vars["semver_minor"] = match[1] + "." + match[2]
+	}
+	return vars
+}
+
+// renderTags expands every template with vars. A template that refers to an
+// empty value is skipped, `latest` only applies on the default branch, and the
+// result is made a valid, de-duplicated list of image tags.
+func renderTags(templates []string, vars map[string]string, defaultBranch string) ([]string, error) {
+	if len(templates) == 0 {
+		tags, err := renderTags([]string{DEFAULT_TAG_TEMPLATE}, vars, defaultBranch)
+		if err != nil {
+			// outside a git checkout there is no sha to tag with
+			return renderTags([]string{FALLBACK_TAG_TEMPLATE}, vars, defaultBranch)
+		}
+		return tags, nil
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, template := range templates {
+		if strings.TrimSpace(template) == "latest" && vars["branch"] != defaultBranch {
+			fmt.Printf("tag [latest] skipped : branch [%s] is not the default branch \n", vars["branch"])
+			continue
+		}
+
+		var missing, unknown []string
+		tag := tagVariable.ReplaceAllStringFunc(template, func(match string) string {
+			name := tagVariable.FindStringSubmatch(match)[1]
+			value, ok := vars[name]
+			if !ok {
+				unknown = append(unknown, name)
+			} else if value == "" {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("tag template [%s] : unknown variables %v", template, unknown)
+		}
+		if len(missing) > 0 {
+			fmt.Printf("tag template [%s] skipped : no value for %v \n", template, missing)
+			continue
+		}
+
+		tag = sanitizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	if len(tags) == 0 {
+		return nil, errors.New("no image tag could be rendered from the tag templates")
+	}
+	return tags, nil
+}
+
+// sanitizeTag maps tag onto the characters a registry accepts, which must not
+// lead with a dot or dash and are limited to 128.
+func sanitizeTag(tag string) string {
+	tag = strings.TrimLeft(tagUnsafe.ReplaceAllString(strings.TrimSpace(tag), "-"), ".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
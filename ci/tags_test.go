@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTagVariables(branch string, sha string, gitTag string) map[string]string {
+	spec := &buildSpec{BuildRun: &BuildRun{Id: "run-1", RepoMeta: RepoMeta{Branch: branch, CommitSha: sha}}}
+	return tagVariables(spec, &RepoCheckout{Tag: gitTag}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+}
+
+func TestRenderTags(t *testing.T) {
+	main := testTagVariables("main", "1a2b3c4d5e6f", "")
+	feature := testTagVariables("feature/login", "1a2b3c4d5e6f", "")
+	release := testTagVariables("main", "1a2b3c4d5e6f", "v1.2.3")
+	noCommit := testTagVariables("main", "", "")
+
+	tests := []struct {
+		name      string
+		templates []string
+		vars      map[string]string
+		want      []string
+		wantErr   string
+	}{
+		{name: "default template", vars: main, want: []string{"1a2b3c4-20240102030405"}},
+		{name: "fallback without a commit", vars: noCommit, want: []string{"build-20240102030405"}},
+		{name: "branch is sanitized", templates: []string{"{{branch}}-{{sha7}}"}, vars: feature, want: []string{"feature-login-1a2b3c4"}},
+		{name: "latest on the default branch", templates: []string{"{{sha7}}", "latest"}, vars: main, want: []string{"1a2b3c4", "latest"}},
+		{name: "latest skipped on other branches", templates: []string{"{{sha7}}", "latest"}, vars: feature, want: []string{"1a2b3c4"}},
+		{name: "empty value skips the template", templates: []string{"{{semver}}", "{{sha7}}"}, vars: main, want: []string{"1a2b3c4"}},
+		{name: "semver variables", templates: []string{"{{semver}}", "{{semver_minor}}", "{{semver_major}}", "{{git_tag}}"}, vars: release, want: []string{"1.2.3", "1.2", "1", "v1.2.3"}},
+		{name: "spaces in placeholders", templates: []string{"{{ date }}-{{ build_run_id }}"}, vars: main, want: []string{"20240102-run-1"}},
+		{name: "duplicates removed", templates: []string{"{{sha7}}", "{{ sha7 }}", "{{sha}}"}, vars: main, want: []string{"1a2b3c4", "1a2b3c4d5e6f"}},
+		{name: "unknown variable", templates: []string{"{{version}}"}, vars: main, wantErr: "unknown variables [version]"},
+		{name: "capitalized variable", templates: []string{"{{Branch}}-{{sha7}}"}, vars: main, wantErr: "unknown variables [Branch]"},
+		{name: "nothing rendered", templates: []string{"{{semver}}", "latest"}, vars: feature, wantErr: "no image tag"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTags(tt.templates, tt.vars, "main")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renderTags() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderTags() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("renderTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"v1.2.3", "v1.2.3"},
+		{"feature/login", "feature-login"},
+		{"  spaced out  ", "spaced-out"},
+		{"a//b@@c", "a-b-c"},
+		{".hidden", "hidden"},
+		{"-/leading", "leading"},
+		{"/", ""},
+		{strings.Repeat("a", 200), strings.Repeat("a", 128)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeTag(tt.tag); got != tt.want {
+			t.Errorf("sanitizeTag(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
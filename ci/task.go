@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TaskOptions carries invocation level inputs shared by every task.
+type TaskOptions struct {
+	UserRepoLoc string
+	// ImageTarball, when set, also exports the built image as an OCI tarball.
+	ImageTarball string
+	// HeartbeatInterval is the delay between progress heartbeats, 0 disables them.
+	HeartbeatInterval time.Duration
+	// CancelPollInterval is the delay between checks for a cancel issued from
+	// the argonaut ui, 0 disables them.
+	CancelPollInterval time.Duration
+	// CacheDir holds cache volume tarballs restored before and saved after a
+	// build, empty keeps caches inside the engine only.
+	CacheDir string
+	// ArtifactDir receives supply chain documents such as the provenance.
+	ArtifactDir string
+	// VulnDBPath is the offline vulnerability database for the scan gate, a
+	// grype database directory or archive.
+	VulnDBPath string
+	// LogOutput receives the dagger engine output, stdout when nil.
+	LogOutput io.Writer
+}
+
+func (o TaskOptions) artifactDir() string {
+	if o.ArtifactDir == "" {
+		return DEFAULT_ARTIFACT_DIR
+	}
+	return o.ArtifactDir
+}
+
+func (o TaskOptions) logOutput() io.Writer {
+	if o.LogOutput == nil {
+		return os.Stdout
+	}
+	return o.LogOutput
+}
+
+// Task is a unit of work the ci binary runs for an argonaut task id.
+type Task interface {
+	// ParseID extracts the backend identifier from a prefixed task id.
+	ParseID(taskId string) (string, error)
+	// FetchSpec loads everything the task needs from the argonaut backend.
+	FetchSpec(ctx context.Context, id string) error
+	// Run executes the task against the checked out user repository.
+	Run(ctx context.Context, opts TaskOptions) error
+	// Report sends the outcome of the task back to the argonaut backend.
+	Report(ctx context.Context, runErr error) error
+}
+
+type TaskDefinition struct {
+	Prefix      string
+	Name        string
+	Description string
+	New         func() Task
+}
+
+var taskRegistry = map[string]TaskDefinition{}
+
+// RegisterTask makes a task kind available to the binary. Task modules call it
+// from their init function.
+func RegisterTask(def TaskDefinition) {
+	if def.Prefix == "" || def.New == nil {
+		panic(fmt.Sprintf("invalid task definition : [%s]", def.Name))
+	}
+	if _, ok := taskRegistry[def.Prefix]; ok {
+		panic(fmt.Sprintf("task prefix already registered : [%s]", def.Prefix))
+	}
+	taskRegistry[def.Prefix] = def
+}
+
+func LookupTask(taskId string) (TaskDefinition, error) {
+	for prefix, def := range taskRegistry {
+		if strings.HasPrefix(taskId, prefix) {
+			return def, nil
+		}
+	}
+	return TaskDefinition{}, fmt.Errorf("unknown task type : [%s]", taskId)
+}
+
+func RegisteredTasks() []TaskDefinition {
+	defs := make([]TaskDefinition, 0, len(taskRegistry))
+	for _, def := range taskRegistry {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Prefix < defs[j].Prefix })
+	return defs
+}
+
+func trimTaskPrefix(taskId string, prefix string) (string, error) {
+	id := strings.TrimPrefix(taskId, prefix)
+	if id == "" || id == taskId {
+		return "", fmt.Errorf("invalid task identifier : [%s]", taskId)
+	}
+	return id, nil
+}
+
+// runTask drives a task through its lifecycle. Report is always invoked once
+// the task id is understood, so the backend hears about fetch failures too.
+func runTask(ctx context.Context, taskId string, opts TaskOptions) error {
+	def, err := LookupTask(taskId)
+	if err != nil {
+		return err
+	}
+
+	task := def.New()
+	id, err := task.ParseID(taskId)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s task started!! \n", def.Name)
+
+	err = task.FetchSpec(ctx, id)
+	switch {
+	case isAuthError(err):
+		err = fmt.Errorf("%w, check the argonaut auth key and secret", err)
+	case isNotFoundError(err):
+		err = fmt.Errorf("%w, check the task id [%s]", err, taskId)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = task.Run(ctx, opts)
+	}
+
+	if reportErr := task.Report(ctx, err); reportErr != nil {
+		fmt.Printf("%s task report failed : [%v] \n", def.Name, reportErr)
+	}
+
+	return err
+}
+
+func printTasks() {
+	fmt.Printf("%-8s %-10s %s\n", "PREFIX", "NAME", "DESCRIPTION")
+	for _, def := range RegisteredTasks() {
+		fmt.Printf("%-8s %-10s %s\n", def.Prefix, def.Name, def.Description)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldError is one field of a response that does not satisfy its tags.
+type FieldError struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// ValidationError lists every invalid field of a decoded response.
+type ValidationError struct {
+	Type   string
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		problems[i] = field.Field + " " + field.Problem
+	}
+	return fmt.Sprintf("invalid %s : %s", e.Type, strings.Join(problems, "; "))
+}
+
+// validateStruct checks out, a pointer to a dto, against the validate and
+// enums tags of its fields, nested structs included. Supported rules:
+//
+//	validate:"required"                        the field is not empty
+//	validate:"required_if=<path> <value>"      required when the field at the
+//	                                           json path from out has value
+//	validate:"required_unless=<path> <value>"  required unless the field at the
+//	                                           json path from out has value
+//	enums:"a,b"                                a non empty value is one of a or b
+//
+// out is only read, defaults are up to the caller.
+func validateStruct(out interface{}) error {
+	root := reflect.Indirect(reflect.ValueOf(out))
+	if root.Kind() != reflect.Struct {
+		return nil
+	}
+	v := &validator{root: root}
+	v.walk(root, "")
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Type: root.Type().Name(), Fields: v.fields}
+}
+
+type validator struct {
+	root   reflect.Value
+	fields []FieldError
+}
+
+func (v *validator) walk(value reflect.Value, path string) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			v.walk(value.Elem(), path)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			v.walk(value.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			fieldPath := joinPath(path, jsonName(field))
+			v.check(field, value.Field(i), fieldPath)
+			v.walk(value.Field(i), fieldPath)
+		}
+	}
+}
+
+func (v *validator) check(field reflect.StructField, value reflect.Value, path string) {
+	rule := field.Tag.Get("validate")
+	required := rule == "required"
+	if condition := strings.TrimPrefix(rule, "required_if="); condition != rule {
+		other, expected, _ := strings.Cut(condition, " ")
+		required = v.lookup(other) == expected
+	}
+	if condition := strings.TrimPrefix(rule, "required_unless="); condition != rule {
+		other, expected, _ := strings.Cut(condition, " ")
+		required = v.lookup(other) != expected
+	}
+
+	// a missing struct cannot be told apart from an empty one, its fields carry the rules
+	if required && value.Kind() != reflect.Struct && value.IsZero() {
+		v.fields = append(v.fields, FieldError{Field: path, Problem: "is required"})
+		return
+	}
+
+	enums := field.Tag.Get("enums")
+	if enums == "" || value.Kind() != reflect.String || value.String() == "" {
+		return
+	}
+	allowed := strings.Split(enums, ",")
+	for _, option := range allowed {
+		if value.String() == option {
+			return
+		}
+	}
+	v.fields = append(v.fields, FieldError{
+		Field:   path,
+		Problem: fmt.Sprintf("[%s] must be one of %s", value.String(), strings.Join(allowed, ", ")),
+	})
+}
+
+// lookup returns the string value of the field at the dotted json path from
+// the validated struct.
+func (v *validator) lookup(path string) string {
+	value := v.root
+	for _, name := range strings.Split(path, ".") {
+		value = reflect.Indirect(value)
+		if value.Kind() != reflect.Struct {
+			return ""
+		}
+		found := false
+		for i := 0; i < value.NumField(); i++ {
+			if jsonName(value.Type().Field(i)) == name {
+				value, found = value.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return ""
+		}
+	}
+	if value.Kind() != reflect.String {
+		return ""
+	}
+	return value.String()
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testCondition is validated inside a testPipeline, rule paths start at the
+// root of the validated value.
+type testCondition struct {
+	Kind    string `json:"kind"`
+	Address string `json:"address" validate:"required_if=condition.kind remote"`
+}
+
+type testPipeline struct {
+	Condition testCondition `json:"condition"`
+	Steps     []testStep    `json:"steps"`
+}
+
+type testStep struct {
+	Name string `json:"name" validate:"required"`
+	Mode string `json:"mode" enums:"fast,slow"`
+}
+
+func TestValidateStruct(t *testing.T) {
+	validBuild := func() *BuildConfig {
+		return &BuildConfig{
+			BuildType:       Docker,
+			ArtifactoryType: CR,
+			Details: BuildConfigDetails{OCIBuildDetails: OCIBuildDetails{
+				DockerFilePath: "Dockerfile",
+			}},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		value interface{}
+		// want lists the field paths reported invalid, none for a valid value
+		want []string
+	}{
+		{name: "valid build", value: validBuild()},
+		{
+			name: "required missing",
+			value: func() interface{} {
+				b := validBuild()
+				b.ArtifactoryType = ""
+				return b
+			}(),
+			want: []string{"artifactory_type"},
+		},
+		{
+			name: "docker build without dockerfile",
+			value: func() interface{} {
+				b := validBuild()
+				b.Details.OCIBuildDetails.DockerFilePath = ""
+				return b
+			}(),
+			want: []string{"details.oci_build_details.docker_file_path"},
+		},
+		{
+			name: "default build type without dockerfile",
+			value: func() interface{} {
+				b := validBuild()
+				b.BuildType = ""
+				b.Details.OCIBuildDetails.DockerFilePath = ""
+				return b
+			}(),
+			want: []string{"details.oci_build_details.docker_file_path"},
+		},
+		{
+			name: "buildpack build without dockerfile",
+			value: func() interface{} {
+				b := validBuild()
+				b.BuildType = BuildPack
+				b.Details.OCIBuildDetails.DockerFilePath = ""
+				return b
+			}(),
+		},
+		{
+			name: "unknown build type",
+			value: func() interface{} {
+				b := validBuild()
+				b.BuildType = "kaniko"
+				return b
+			}(),
+			want: []string{"build_type"},
+		},
+		{
+			name: "nested enum",
+			value: func() interface{} {
+				b := validBuild()
+				b.Details.OCIBuildDetails.Scan.FailOn = "urgent"
+				return b
+			}(),
+			want: []string{"details.oci_build_details.scan.fail_on"},
+		},
+		{
+			name: "every invalid field",
+			value: &DeployRun{
+				ManifestType: "jsonnet",
+				ManifestPath: "deploy",
+				Strategy:     Apply,
+			},
+			want: []string{"build_run_id", "status", "manifest_type"},
+		},
+		{
+			name:  "required if condition met",
+			value: &testPipeline{Condition: testCondition{Kind: "remote"}},
+			want:  []string{"condition.address"},
+		},
+		{
+			name:  "required if condition not met",
+			value: &testPipeline{Condition: testCondition{Kind: "local"}},
+		},
+		{
+			name: "list items",
+			value: &testPipeline{Steps: []testStep{
+				{Name: "build", Mode: "fast"},
+				{Mode: "slow"},
+				{Name: "push", Mode: "eventually"},
+			}},
+			want: []string{"steps[1].name", "steps[2].mode"},
+		},
+		{name: "not a struct", value: "build"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStruct(tt.value)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("validateStruct() error = %v, want none", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("validateStruct() error = %v, want a ValidationError", err)
+			}
+			got := []string{}
+			for _, field := range validationErr.Fields {
+				got = append(got, field.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateStruct() fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateStructLeavesInputAlone(t *testing.T) {
+	config := BuildConfig{ArtifactoryType: CR, Details: BuildConfigDetails{OCIBuildDetails: OCIBuildDetails{DockerFilePath: "Dockerfile"}}}
+	if err := validateStruct(&config); err != nil {
+		t.Fatalf("validateStruct() error = %v", err)
+	}
+	if config.BuildType != "" {
+		t.Errorf("validateStruct() set build_type to [%s]", config.BuildType)
+	}
+}
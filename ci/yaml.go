@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// unmarshalDocument decodes a json or yaml document into out using the json
+// tags of out, so the same dto shapes are accepted in both formats.
+func unmarshalDocument(data []byte, out interface{}) error {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		return json.Unmarshal(data, out)
+	}
+
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	value, err := yamlValue(&root, reflect.TypeOf(out))
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, out)
+}
+
+// yamlValue converts node into a value encoding/json can marshal. Scalars
+// that land in a string field stay strings, so a secret value of 1234 or a
+// tag template of digits is not turned into a number; t is nil where the
+// target type is not known.
+func yamlValue(node *yaml.Node, t reflect.Type) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		return yamlValue(node.Content[0], t)
+	case yaml.AliasNode:
+		return yamlValue(node.Alias, t)
+	case yaml.SequenceNode:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		out := make([]interface{}, 0, len(node.Content))
+		for _, item := range node.Content {
+			value, err := yamlValue(item, elem)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, value)
+		}
+		return out, nil
+	case yaml.MappingNode:
+		out := map[string]interface{}{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			value, err := yamlValue(node.Content[i+1], fieldType(t, key))
+			if err != nil {
+				return nil, err
+			}
+			out[key] = value
+		}
+		return out, nil
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil, nil
+		}
+		if t != nil && t.Kind() == reflect.String {
+			return node.Value, nil
+		}
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	default:
+		return nil, fmt.Errorf("yaml line %d : unsupported node", node.Line)
+	}
+}
+
+// fieldType is the type of the value under key in a struct, by json name, or
+// in a map.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if jsonName(t.Field(i)) == key {
+				return t.Field(i).Type
+			}
+		}
+	}
+	return nil
+}
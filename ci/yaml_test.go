@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    LocalBuildDocument
+		wantErr bool
+	}{
+		{
+			name: "documented yaml",
+			doc: `
+build_config:
+  name: my-app
+  build_type: docker
+  details:
+    oci_build_details:
+      docker_file_path: Dockerfile
+      working_dir: .
+registry_access:
+  url_with_prefix: localhost:5000
+secrets:
+  - key: NPM_TOKEN
+    value: xxxx
+`,
+			want: LocalBuildDocument{
+				BuildConfig: BuildConfig{
+					Name:      "my-app",
+					BuildType: Docker,
+					Details: BuildConfigDetails{OCIBuildDetails: OCIBuildDetails{
+						DockerFilePath: "Dockerfile",
+						WorkingDir:     ".",
+					}},
+				},
+				RegistryAccess: &RegistryAccess{UrlWithPrefix: "localhost:5000"},
+				Secrets:        []BuildSecret{{Key: "NPM_TOKEN", Value: "xxxx"}},
+			},
+		},
+		{
+			name: "numeric looking strings stay strings",
+			doc: `
+build_config:
+  name: 2024
+  details:
+    oci_build_details:
+      tags: [20240101, "1.0"]
+      labels:
+        version: 1.10
+      secret_modes:
+        PIN: file
+secrets:
+  - key: PIN
+    value: 1234
+  - key: FLAG
+    value: true
+`,
+			want: LocalBuildDocument{
+				BuildConfig: BuildConfig{
+					Name: "2024",
+					Details: BuildConfigDetails{OCIBuildDetails: OCIBuildDetails{
+						Tags:        []string{"20240101", "1.0"},
+						Labels:      map[string]string{"version": "1.10"},
+						SecretModes: map[string]SecretMode{"PIN": SecretFile},
+					}},
+				},
+				Secrets: []BuildSecret{{Key: "PIN", Value: "1234"}, {Key: "FLAG", Value: "true"}},
+			},
+		},
+		{
+			name: "typed scalars",
+			doc: `
+build_config:
+  name: app
+  details:
+    oci_build_details:
+      platforms:
+        - linux/amd64
+        - linux/arm64
+      cache:
+        disable: true
+      scan:
+        enabled: true
+`,
+			want: LocalBuildDocument{
+				BuildConfig: BuildConfig{
+					Name: "app",
+					Details: BuildConfigDetails{OCIBuildDetails: OCIBuildDetails{
+						Platforms: []string{"linux/amd64", "linux/arm64"},
+						Cache:     CacheConfig{Disable: true},
+						Scan:      ScanConfig{Enabled: true},
+					}},
+				},
+			},
+		},
+		{
+			name: "json",
+			doc:  `{"build_config": {"name": "app", "build_type": "buildpack"}, "secrets": [{"key": "A", "value": "1"}]}`,
+			want: LocalBuildDocument{
+				BuildConfig: BuildConfig{Name: "app", BuildType: BuildPack},
+				Secrets:     []BuildSecret{{Key: "A", Value: "1"}},
+			},
+		},
+		{
+			name: "anchors",
+			doc: `
+build_config:
+  name: &name app
+  details:
+    oci_build_details:
+      tags: [*name]
+`,
+			want: LocalBuildDocument{
+				BuildConfig: BuildConfig{
+					Name:    "app",
+					Details: BuildConfigDetails{OCIBuildDetails: OCIBuildDetails{Tags: []string{"app"}}},
+				},
+			},
+		},
+		{
+			name:    "invalid yaml",
+			doc:     "build_config:\n  name: [app\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LocalBuildDocument{}
+			err := unmarshalDocument([]byte(tt.doc), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalDocument() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unmarshalDocument() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}